@@ -0,0 +1,370 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// k8sauditbench replays synthetic or captured K8S Audit events at a
+// configurable rate against an event source of the k8saudit plugin, and
+// reports the end-to-end throughput and latency of the events. The plugin
+// runs in-process, and each event is sent with its stageTimestamp set to
+// the time at which it is sent, so that its latency is measured as the
+// time elapsed until it gets emitted by the event source.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/falcosecurity/plugin-sdk-go/pkg/sdk"
+	"github.com/falcosecurity/plugins/plugins/k8saudit/pkg/k8saudit"
+	"github.com/valyala/fastjson"
+)
+
+const (
+	// drainTimeout is the time waited for the events still in flight after
+	// the generator stops sending
+	drainTimeout = 5 * time.Second
+	//
+	// connectTimeout is the time waited for the webhook of the event
+	// source to start accepting connections
+	connectTimeout = 5 * time.Second
+)
+
+var (
+	sourceFlag   = flag.String("source", "http://127.0.0.1:9765/k8s-audit", "open params of the event source (a webhook URL or a file path)")
+	configFlag   = flag.String("config", "{}", "init config of the plugin, in JSON")
+	inputFlag    = flag.String("input", "", "file of captured audit events in JSONL to replay instead of synthetic ones")
+	rateFlag     = flag.Float64("rate", 1000, "events sent per second, or zero to send as fast as possible")
+	durationFlag = flag.Duration("duration", 10*time.Second, "duration of the benchmark")
+	batchFlag    = flag.Int("batch", 1, "events per webhook request, sent as an EventList if greater than one")
+	insecureFlag = flag.Bool("insecure", false, "skip the verification of the webhook certificate for https sources")
+)
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	if *batchFlag < 1 {
+		return fmt.Errorf("invalid batch: must be greater than zero")
+	}
+	u, err := url.Parse(*sourceFlag)
+	if err != nil {
+		return err
+	}
+	isFile := u.Scheme == ""
+
+	// file sources must follow the file, as events are appended to it
+	config := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(*configFlag), &config); err != nil {
+		return fmt.Errorf("invalid config: %s", err.Error())
+	}
+	setDefault(config, "logLevel", "warn")
+	setDefault(config, "summaryIntervalSecs", 0)
+	if isFile {
+		setDefault(config, "fileEOFBehavior", "follow")
+	}
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	var templates []*fastjson.Value
+	if len(*inputFlag) > 0 {
+		if templates, err = readTemplates(*inputFlag); err != nil {
+			return err
+		}
+	}
+
+	var send func([][]byte) error
+	if isFile {
+		// existing files are never truncated, and are refused if not
+		// empty as their events would be counted in the results
+		file, err := os.OpenFile(*sourceFlag, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() > 0 {
+			return fmt.Errorf("source file %s is not empty", *sourceFlag)
+		}
+		send = fileSender(file)
+	} else {
+		send = webhookSender(*sourceFlag, *insecureFlag)
+	}
+
+	plugin := &k8saudit.Plugin{}
+	if err := plugin.Init(string(configJSON)); err != nil {
+		return err
+	}
+	defer plugin.Destroy()
+	instance, err := plugin.Open(*sourceFlag)
+	if err != nil {
+		return err
+	}
+	defer instance.(sdk.Closer).Close()
+
+	// send the events in the background, while the main goroutine
+	// consumes them from the event source
+	var sent, failed uint64
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		defer close(done)
+		gen := &generator{templates: templates}
+		for time.Since(start) < *durationFlag {
+			if *rateFlag > 0 {
+				next := start.Add(time.Duration(float64(sent) / *rateFlag * float64(time.Second)))
+				time.Sleep(time.Until(next))
+			}
+			batch := gen.next(*batchFlag)
+			if err := send(batch); err != nil {
+				fmt.Fprintf(os.Stderr, "send failed: %s\n", err.Error())
+				atomic.AddUint64(&failed, uint64(len(batch)))
+			}
+			atomic.AddUint64(&sent, uint64(len(batch)))
+		}
+	}()
+
+	evts := newBenchEvents(int(plugin.Config.BatchSize))
+	var latencies []time.Duration
+	var drainStart time.Time
+	for {
+		n, err := instance.(sdk.NextBatcher).NextBatch(plugin, evts)
+		now := time.Now()
+		for i := 0; i < n; i++ {
+			latencies = append(latencies, now.Sub(time.Unix(0, int64(evts[i].ts))))
+		}
+		if err != nil && err != sdk.ErrTimeout {
+			if err == sdk.ErrEOF {
+				break
+			}
+			return err
+		}
+
+		// once the generator is done, wait for the events in flight
+		select {
+		case <-done:
+			if drainStart.IsZero() {
+				drainStart = now
+			}
+		default:
+		}
+		if !drainStart.IsZero() {
+			expected := atomic.LoadUint64(&sent) - atomic.LoadUint64(&failed)
+			if uint64(len(latencies)) >= expected || now.Sub(drainStart) > drainTimeout {
+				break
+			}
+		}
+	}
+	elapsed := time.Since(start)
+
+	report(os.Stdout, elapsed, atomic.LoadUint64(&sent), atomic.LoadUint64(&failed), latencies)
+	return nil
+}
+
+func setDefault(config map[string]interface{}, key string, value interface{}) {
+	if _, ok := config[key]; !ok {
+		config[key] = value
+	}
+}
+
+// readTemplates reads the captured audit events used as templates of the
+// sent events. Each line of the file must contain a JSON audit event.
+func readTemplates(path string) ([]*fastjson.Value, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var res []*fastjson.Value
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		value, err := fastjson.ParseBytes(scanner.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("can't parse input event: %s", err.Error())
+		}
+		res = append(res, value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no events found in %s", path)
+	}
+	return res, nil
+}
+
+// generator produces the audit events sent to the event source. Each
+// event has a unique auditID, and its stageTimestamp set to the current
+// time. Captured events are replayed in a round-robin fashion.
+type generator struct {
+	templates []*fastjson.Value
+	arena     fastjson.Arena
+	count     uint64
+}
+
+func (g *generator) next(n int) [][]byte {
+	res := make([][]byte, n)
+	for i := range res {
+		g.count++
+		auditID := fmt.Sprintf("k8sauditbench-%d-%d", os.Getpid(), g.count)
+		timestamp := time.Now().UTC().Format(time.RFC3339Nano)
+		if len(g.templates) == 0 {
+			res[i] = []byte(fmt.Sprintf(syntheticEvent, auditID, timestamp, timestamp))
+			continue
+		}
+		g.arena.Reset()
+		value := g.templates[int(g.count)%len(g.templates)]
+		value.Set("auditID", g.arena.NewString(auditID))
+		value.Set("stageTimestamp", g.arena.NewString(timestamp))
+		res[i] = value.MarshalTo(nil)
+	}
+	return res
+}
+
+// syntheticEvent is the template of the synthetic audit events, with the
+// auditID and the requestReceivedTimestamp and stageTimestamp as arguments
+const syntheticEvent = `{"kind":"Event","apiVersion":"audit.k8s.io/v1","level":"Request","auditID":"%s",` +
+	`"stage":"ResponseComplete","requestURI":"/api/v1/namespaces/default/configmaps","verb":"create",` +
+	`"user":{"username":"system:serviceaccount:default:k8sauditbench","groups":["system:serviceaccounts","system:authenticated"]},` +
+	`"sourceIPs":["10.0.0.1"],"userAgent":"k8sauditbench",` +
+	`"objectRef":{"resource":"configmaps","namespace":"default","name":"k8sauditbench","apiVersion":"v1"},` +
+	`"responseStatus":{"metadata":{},"code":201},` +
+	`"requestObject":{"kind":"ConfigMap","apiVersion":"v1","metadata":{"name":"k8sauditbench","namespace":"default"},"data":{"key":"value"}},` +
+	`"requestReceivedTimestamp":"%s","stageTimestamp":"%s"}`
+
+// fileSender returns a function appending events to a file, one per line
+func fileSender(file *os.File) func([][]byte) error {
+	return func(batch [][]byte) error {
+		_, err := file.Write(append(bytes.Join(batch, []byte("\n")), '\n'))
+		return err
+	}
+}
+
+// webhookSender returns a function posting events to a webhook. Batches
+// of more than one event are sent as an EventList.
+func webhookSender(address string, insecure bool) func([][]byte) error {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+		},
+	}
+	ready := false
+	return func(batch [][]byte) error {
+		body := batch[0]
+		if len(batch) > 1 {
+			body = []byte(`{"kind":"EventList","apiVersion":"audit.k8s.io/v1","items":[` +
+				string(bytes.Join(batch, []byte(","))) + `]}`)
+		}
+		// retry until the webhook server accepts connections
+		deadline := time.Now().Add(connectTimeout)
+		for {
+			res, err := client.Post(address, "application/json", bytes.NewReader(body))
+			if err != nil {
+				if !ready && time.Now().Before(deadline) {
+					time.Sleep(50 * time.Millisecond)
+					continue
+				}
+				return err
+			}
+			ready = true
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				return fmt.Errorf("unexpected status: %s", res.Status)
+			}
+			return nil
+		}
+	}
+}
+
+// benchEvent is an event of the batches returned by the event source,
+// which only retains the timestamp of the event
+type benchEvent struct {
+	ts uint64
+}
+
+func (b *benchEvent) Writer() io.Writer         { return ioutil.Discard }
+func (b *benchEvent) SetTimestamp(value uint64) { b.ts = value }
+
+// benchEvents implements sdk.EventWriters in Go memory, so that the
+// timestamps of the emitted events can be read back
+type benchEvents []*benchEvent
+
+func newBenchEvents(size int) benchEvents {
+	res := make(benchEvents, size)
+	for i := range res {
+		res[i] = &benchEvent{}
+	}
+	return res
+}
+
+func (b benchEvents) Get(eventIndex int) sdk.EventWriter { return b[eventIndex] }
+func (b benchEvents) Len() int                           { return len(b) }
+func (b benchEvents) ArrayPtr() unsafe.Pointer           { return nil }
+func (b benchEvents) Free()                              {}
+
+// report writes the throughput and latency of the benchmark
+func report(w io.Writer, elapsed time.Duration, sent, failed uint64, latencies []time.Duration) {
+	received := uint64(len(latencies))
+	fmt.Fprintf(w, "duration:   %s\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "sent:       %d events (%d failed)\n", sent, failed)
+	fmt.Fprintf(w, "emitted:    %d events (%.1f events/s)\n", received, float64(received)/elapsed.Seconds())
+	if sent > failed && received < sent-failed {
+		fmt.Fprintf(w, "missing:    %d events\n", sent-failed-received)
+	}
+	if received == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var quantiles []string
+	for _, q := range []float64{0.5, 0.9, 0.99, 1} {
+		latency := latencies[int(q*float64(received-1))]
+		name := fmt.Sprintf("p%g", q*100)
+		if q == 1 {
+			name = "max"
+		}
+		quantiles = append(quantiles, fmt.Sprintf("%s=%s", name, latency.Round(time.Microsecond)))
+	}
+	fmt.Fprintf(w, "latency:    %s\n", strings.Join(quantiles, " "))
+}
@@ -1,9 +1,10 @@
 module github.com/falcosecurity/plugins/plugins/k8saudit
 
-go 1.15
+go 1.16
 
 require (
 	github.com/alecthomas/jsonschema v0.0.0-20220216202328-9eeeec9d044b
 	github.com/falcosecurity/plugin-sdk-go v0.4.0
+	github.com/itchyny/gojq v0.12.7
 	github.com/valyala/fastjson v1.6.3
 )
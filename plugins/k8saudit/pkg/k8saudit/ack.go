@@ -0,0 +1,129 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sourceMessage is a message received by an event source, such as the body
+// of a webhook request or a JSON object read from a file. If not nil, done
+// is invoked once all the events of the message have been either emitted
+// or dropped, so that the position of the message can be committed. If not
+// zero, received is the time at which the event source started receiving
+// the message, otherwise the message is considered received once dequeued.
+type sourceMessage struct {
+	data     []byte
+	done     func()
+	received time.Time
+}
+
+// messageAck tracks the delivery of the events of a message, and invokes
+// the done callback of the message once all of them have been delivered.
+type messageAck struct {
+	refs int32
+	done func()
+}
+
+// newMessageAck returns the ack of a message. The returned ack holds a
+// reference until release is called, so that done is not invoked while the
+// events of the message are still being produced. Returns nil if done is nil.
+func newMessageAck(done func()) *messageAck {
+	if done == nil {
+		return nil
+	}
+	return &messageAck{refs: 1, done: done}
+}
+
+// add binds an event to the ack, so that the message is not done until
+// the event is delivered
+func (a *messageAck) add(e *auditEvent) {
+	if a != nil {
+		a.hold()
+		e.ack = a
+	}
+}
+
+// hold adds a reference to the ack, so that the message is not done until
+// the reference is released
+func (a *messageAck) hold() {
+	if a != nil {
+		atomic.AddInt32(&a.refs, 1)
+	}
+}
+
+func (a *messageAck) release() {
+	if a != nil && atomic.AddInt32(&a.refs, -1) == 0 {
+		a.done()
+	}
+}
+
+// delivered signals that the event has been either emitted or dropped
+func (e *auditEvent) delivered() {
+	e.ack.release()
+	e.ack = nil
+}
+
+// commitQueue commits the positions of the messages of an event source in
+// the order in which they have been read, even if their events are
+// delivered out of order, so that a committed position never skips a
+// message that has not been delivered yet.
+type commitQueue struct {
+	mu    sync.Mutex
+	seq   uint64
+	next  uint64
+	ready map[uint64]func()
+}
+
+func newCommitQueue() *commitQueue {
+	return &commitQueue{ready: make(map[uint64]func())}
+}
+
+// Add registers the commit function of the next message in read order,
+// and returns the done callback of the message. The commit functions are
+// invoked with the queue lock held, once the message and all the previous
+// ones are done.
+func (q *commitQueue) Add(commit func()) func() {
+	q.mu.Lock()
+	seq := q.seq
+	q.seq++
+	q.mu.Unlock()
+	return func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.ready[seq] = commit
+		for {
+			commit, ok := q.ready[q.next]
+			if !ok {
+				return
+			}
+			delete(q.ready, q.next)
+			q.next++
+			commit()
+		}
+	}
+}
+
+// Do invokes fn with the queue lock held, so that it never runs
+// concurrently with the commit functions
+func (q *commitQueue) Do(fn func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	fn()
+}
@@ -0,0 +1,62 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"math/bits"
+	"sync"
+)
+
+const (
+	// minBufferSizeClass and maxBufferSizeClass are the base-2 logarithms
+	// of the smallest and largest buffer sizes kept in the buffer pools.
+	// Larger buffers are rare enough that they are left to the GC, so that
+	// a single huge event does not pin its memory for the plugin lifetime.
+	minBufferSizeClass = 10 // 1KiB
+	maxBufferSizeClass = 24 // 16MiB
+)
+
+// bufferPools contains a pool of byte buffers for each size class, so that
+// the buffers used to serialize events are reused instead of being
+// allocated from scratch for each event.
+var bufferPools [maxBufferSizeClass - minBufferSizeClass + 1]sync.Pool
+
+// getBuffer returns an empty byte buffer with a capacity of at least size
+// bytes, taking it from the pool of the matching size class if possible.
+func getBuffer(size int) []byte {
+	class := minBufferSizeClass
+	if size > 1<<minBufferSizeClass {
+		class = bits.Len(uint(size - 1))
+	}
+	if class > maxBufferSizeClass {
+		return make([]byte, 0, size)
+	}
+	if buf, ok := bufferPools[class-minBufferSizeClass].Get().(*[]byte); ok {
+		return (*buf)[:0]
+	}
+	return make([]byte, 0, 1<<class)
+}
+
+// putBuffer returns a byte buffer to the pool of its size class. The buffer
+// must not be used by the caller anymore.
+func putBuffer(buf []byte) {
+	class := bits.Len(uint(cap(buf))) - 1
+	if class < minBufferSizeClass || class > maxBufferSizeClass {
+		return
+	}
+	bufferPools[class-minBufferSizeClass].Put(&buf)
+}
@@ -0,0 +1,60 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"testing"
+)
+
+func TestGetBuffer(t *testing.T) {
+	// buffers are rounded up to the size of their class, unless they are
+	// larger than the largest class
+	tests := []struct {
+		size     int
+		capacity int
+	}{
+		{0, 1 << 10},
+		{1 << 10, 1 << 10},
+		{1<<10 + 1, 1 << 11},
+		{100000, 1 << 17},
+		{1 << 24, 1 << 24},
+		{1<<24 + 1, 1<<24 + 1},
+	}
+	for _, test := range tests {
+		buf := getBuffer(test.size)
+		if len(buf) != 0 || cap(buf) < test.capacity {
+			t.Errorf("getBuffer(%d): expected an empty buffer of capacity at least %d, got len=%d cap=%d", test.size, test.capacity, len(buf), cap(buf))
+		}
+	}
+}
+
+func TestPutBuffer(t *testing.T) {
+	// buffers of any capacity can be returned to the pools, and the pooled
+	// buffers are always large enough for the requested size, and empty
+	for _, capacity := range []int{0, 100, 1 << 10, 3000, 1<<11 - 1, 1 << 20, 1 << 25} {
+		putBuffer(append(make([]byte, 0, capacity), "data"...))
+	}
+	for _, size := range []int{0, 1000, 2048, 3000, 4096, 1 << 20} {
+		for i := 0; i < 3; i++ {
+			buf := getBuffer(size)
+			if len(buf) != 0 || cap(buf) < size {
+				t.Errorf("getBuffer(%d): got len=%d cap=%d", size, len(buf), cap(buf))
+			}
+			putBuffer(buf)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const checkpointSaveInterval = time.Second
+
+// fileCheckpoint is the read position of a file source. The inode is
+// used to detect whether the file has been replaced (e.g. rotated) since
+// the checkpoint has been saved.
+type fileCheckpoint struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// checkpointStore persists the checkpoints of the file sources in a
+// JSON state file, indexed by absolute file path. The store can be shared
+// across many opened event sources.
+type checkpointStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func newCheckpointStore(path string) *checkpointStore {
+	return &checkpointStore{path: path}
+}
+
+// Load returns the checkpoint of the given file, or nil if there is none or
+// if the checkpoint refers to a different file that had the same path.
+func (c *checkpointStore) Load(filePath string, info os.FileInfo) (*fileCheckpoint, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	checkpoints, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	cp, ok := checkpoints[filePath]
+	if !ok || cp.Inode != fileInode(info) || cp.Offset > info.Size() {
+		return nil, nil
+	}
+	return cp, nil
+}
+
+// Save persists the checkpoint of the given file. The state file is
+// replaced atomically, so that it's never left in a corrupted state.
+func (c *checkpointStore) Save(filePath string, cp *fileCheckpoint) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	checkpoints, err := c.read()
+	if err != nil {
+		return err
+	}
+	checkpoints[filePath] = cp
+	data, err := json.Marshal(checkpoints)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path, data)
+}
+
+func (c *checkpointStore) read() (map[string]*fileCheckpoint, error) {
+	checkpoints := make(map[string]*fileCheckpoint)
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return checkpoints, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &checkpoints); err != nil {
+		return nil, err
+	}
+	return checkpoints, nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to the
+// given path, so that the file is never left in a partially-written state.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// fileInode returns the inode number of a file, or 0 if not available
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
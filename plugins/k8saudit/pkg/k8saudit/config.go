@@ -19,10 +19,42 @@ package k8saudit
 import "github.com/falcosecurity/plugin-sdk-go/pkg/sdk"
 
 type PluginConfig struct {
-	SSLCertificate      string `json:"sslCertificate"       jsonschema:"description=The SSL Certificate to be used with the HTTPS Webhook endpoint (Default: /etc/falco/falco.pem)"`
-	UseAsync            bool   `json:"useAsync"             jsonschema:"description=If true then async extraction optimization is enabled (Default: true)"`
-	MaxEventSize        uint64 `json:"maxEventSize"         jsonschema:"description=Maximum size of single audit event (Default: 262144)"`
-	WebhookMaxBatchSize uint64 `json:"webhookMaxBatchSize"  jsonschema:"description=Maximum size of incoming webhook POST request bodies (Default: 12582912)"`
+	SSLCertificate      string            `json:"sslCertificate"       jsonschema:"description=The SSL Certificate to be used with the HTTPS Webhook endpoint (Default: /etc/falco/falco.pem)"`
+	UseAsync            bool              `json:"useAsync"             jsonschema:"description=If true then async extraction optimization is enabled (Default: true)"`
+	MaxEventSize        uint64            `json:"maxEventSize"         jsonschema:"description=Maximum size of single audit event (Default: 262144)"`
+	WebhookMaxBatchSize uint64            `json:"webhookMaxBatchSize"  jsonschema:"description=Maximum size of incoming webhook POST request bodies (Default: 12582912)"`
+	TruncateLargeEvents bool              `json:"truncateLargeEvents"  jsonschema:"description=If true then events larger than maxEventSize are truncated by removing their responseObject and requestObject instead of being dropped (Default: false)"`
+	RedactSecrets       bool              `json:"redactSecrets"        jsonschema:"description=If true then the data of Secrets is redacted from the request and response objects of audit events (Default: false)"`
+	RedactConfigMaps    bool              `json:"redactConfigMaps"     jsonschema:"description=If true then the data of ConfigMaps is redacted from the request and response objects of audit events (Default: false)"`
+	ClusterName         string            `json:"clusterName"          jsonschema:"description=The name of the cluster the audit events are coming from. If set it is attached to every event and can be extracted with the ka.cluster.name field (Default: empty)"`
+	Labels              map[string]string `json:"labels"               jsonschema:"description=Static key/value labels attached to every event that can be extracted with the ka.label field (e.g. ka.label[environment]) (Default: empty)"`
+	EnrichOwners        bool              `json:"enrichOwners"         jsonschema:"description=If true then events targeting pods are enriched with the workload owning the pod (e.g. Deployment or StatefulSet). This requires Falco to run inside the cluster with read access to pods and replicasets and jobs (Default: false)"`
+	EnrichNodes         bool              `json:"enrichNodes"          jsonschema:"description=If true then events targeting pods are enriched with the node on which the pod is scheduled and its zone and region labels. This requires Falco to run inside the cluster with read access to pods and nodes (Default: false)"`
+	EnrichSecretAccess  bool              `json:"enrichSecretAccess"   jsonschema:"description=If true then events targeting secrets are enriched with whether the secret is referenced by the pod performing the request. This requires Falco to run inside the cluster with read access to pods (Default: false)"`
+	FileCheckpointPath  string            `json:"fileCheckpointPath"   jsonschema:"description=Path of a state file in which the read offset of file sources is persisted. If set then re-opening a file resumes reading from where it was left (Default: empty)"`
+	WebhookSpoolDir     string            `json:"webhookSpoolDir"      jsonschema:"description=Directory of a persistent queue in which the received webhook requests are stored before being processed. If set then the accepted events survive restarts and slow processing periods (Default: empty)"`
+	WebhookSpoolMaxSize uint64            `json:"webhookSpoolMaxSize"  jsonschema:"description=Maximum size in bytes of the webhook persistent queue. Webhook requests are rejected with status 503 while the limit is reached (Default: 1073741824)"`
+	DeadLetterPath      string            `json:"deadLetterPath"       jsonschema:"description=Path of a file in which the payloads that can't be parsed as audit events are written along with the reason of the failure (Default: empty)"`
+	DeadLetterMaxSize   uint64            `json:"deadLetterMaxSize"    jsonschema:"description=Maximum size in bytes of the dead-letter file before it gets rotated (Default: 104857600)"`
+	OverflowPolicy      string            `json:"overflowPolicy"       jsonschema:"enum=block,enum=dropNewest,enum=dropOldest,description=Behavior of the webhook when the ingest queue is full: block waits for room and applies backpressure to the API server while dropNewest and dropOldest discard respectively the incoming or the oldest queued request (Default: block)"`
+	FileEOFBehavior     string            `json:"fileEOFBehavior"      jsonschema:"enum=close,enum=follow,enum=idle,description=Behavior of file sources when reaching the end of the file: close closes the source while follow waits for more data to be appended and idle keeps the source open without producing events so that it does not terminate the capture (Default: close)"`
+	WebhookChanBufSize  uint64            `json:"webhookChanBufSize"   jsonschema:"description=Number of webhook requests that can be queued in memory before being parsed (Default: 50)"`
+	EventChanBufSize    uint64            `json:"eventChanBufSize"     jsonschema:"description=Number of batches of parsed audit events that can be queued in memory before being emitted. Each batch contains up to batchSize events (Default: 0)"`
+	BatchSize           uint64            `json:"batchSize"            jsonschema:"description=Maximum number of events emitted in a single batch (Default: 128)"`
+	BatchTimeoutMs      uint64            `json:"batchTimeoutMs"       jsonschema:"description=Time in milliseconds after which a partial batch of events is emitted if no more events are received (Default: 30)"`
+	DedupStorePath      string            `json:"dedupStorePath"       jsonschema:"description=Path of a file in which the auditID and stage of the emitted events are persisted. If set then events already emitted are discarded even across restarts and overlapping sources (Default: empty)"`
+	DedupTTLSecs        uint64            `json:"dedupTTLSecs"         jsonschema:"description=Time in seconds for which emitted events are remembered by the dedup store (Default: 3600)"`
+	SpillThreshold      uint64            `json:"spillThreshold"       jsonschema:"description=Number of events of a single message above which the remaining events are spilled to a temporary file instead of being parsed in memory. The raw message is still read in memory as a whole, up to webhookMaxBatchSize. Zero disables spilling (Default: 0)"`
+	SpillDir            string            `json:"spillDir"             jsonschema:"description=Directory in which spill files are created. If empty then the default directory for temporary files is used (Default: empty)"`
+	MetricsAddress      string            `json:"metricsAddress"       jsonschema:"description=Address on which the internal metrics of the plugin are served in the Prometheus format at the /metrics endpoint (e.g. :9376). If empty then metrics are not served (Default: empty)"`
+	LogLevel            string            `json:"logLevel"             jsonschema:"enum=debug,enum=info,enum=warn,enum=error,description=Minimum level of the log messages written by the plugin (Default: info)"`
+	LogFormat           string            `json:"logFormat"            jsonschema:"enum=text,enum=json,description=Format of the log messages written by the plugin. The json format writes one JSON object per line (Default: text)"`
+	TracingEndpoint     string            `json:"tracingEndpoint"      jsonschema:"description=Base URL of an OpenTelemetry collector receiving the traces of the ingest path of each event through OTLP/HTTP with JSON encoding (e.g. http://localhost:4318). If empty then tracing is disabled (Default: empty)"`
+	TracingSampleRatio  float64           `json:"tracingSampleRatio"   jsonschema:"description=Ratio of the emitted events that are traced, between 0 and 1 (Default: 1)"`
+	EnablePprof         bool              `json:"enablePprof"          jsonschema:"description=If true then the runtime profiling data is served at the /debug/pprof/ endpoints on the metricsAddress listener (Default: false)"`
+	SummaryIntervalSecs uint64            `json:"summaryIntervalSecs"  jsonschema:"description=Interval in seconds at which a summary of the pipeline health is logged at info level. Zero disables the summary (Default: 60)"`
+	HeartbeatPeriodSecs uint64            `json:"heartbeatPeriodSecs"  jsonschema:"description=Interval in seconds at which each event source injects a synthetic heartbeat event that can be matched with the ka.heartbeat field. Zero disables heartbeats (Default: 0)"`
+	ReorderWindowMs     uint64            `json:"reorderWindowMs"      jsonschema:"description=Time window in milliseconds within which events are sorted by stageTimestamp before being emitted. Zero disables reordering (Default: 0)"`
 }
 
 // Resets sets the configuration to its default values
@@ -30,6 +62,38 @@ func (k *PluginConfig) Reset() {
 	k.SSLCertificate = "/etc/falco/falco.pem"
 	k.UseAsync = true
 	k.MaxEventSize = uint64(sdk.DefaultEvtSize)
+	k.TruncateLargeEvents = false
+	k.RedactSecrets = false
+	k.RedactConfigMaps = false
+	k.ClusterName = ""
+	k.Labels = nil
+	k.EnrichOwners = false
+	k.EnrichNodes = false
+	k.EnrichSecretAccess = false
+	k.FileCheckpointPath = ""
+	k.WebhookSpoolDir = ""
+	k.WebhookSpoolMaxSize = 1024 * 1024 * 1024
+	k.DeadLetterPath = ""
+	k.DeadLetterMaxSize = 100 * 1024 * 1024
+	k.ReorderWindowMs = 0
+	k.OverflowPolicy = overflowPolicyBlock
+	k.FileEOFBehavior = fileEOFClose
+	k.WebhookChanBufSize = webServerEventChanBufSize
+	k.EventChanBufSize = 0
+	k.BatchSize = uint64(sdk.DefaultBatchSize)
+	k.BatchTimeoutMs = uint64(defaultEventTimeout.Milliseconds())
+	k.DedupStorePath = ""
+	k.DedupTTLSecs = 3600
+	k.SpillThreshold = 0
+	k.SpillDir = ""
+	k.MetricsAddress = ""
+	k.LogLevel = logLevelInfo.String()
+	k.LogFormat = logFormatText
+	k.TracingEndpoint = ""
+	k.TracingSampleRatio = 1
+	k.EnablePprof = false
+	k.SummaryIntervalSecs = 60
+	k.HeartbeatPeriodSecs = 0
 
 	// See: https://kubernetes.io/docs/reference/command-line-tools-reference/kube-apiserver/
 	// The K8S docs state states the following:
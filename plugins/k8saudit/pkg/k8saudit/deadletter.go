@@ -0,0 +1,69 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deadLetterWriter appends the payloads that can't be parsed as audit
+// events to a file, each preceded by a header line reporting the time and
+// the reason of the failure. Once the file exceeds its maximum size, it is
+// rotated by renaming it with a ".1" suffix, replacing the previous one.
+type deadLetterWriter struct {
+	path    string
+	maxSize int64
+	mu      sync.Mutex
+}
+
+func newDeadLetterWriter(path string, maxSize int64) *deadLetterWriter {
+	return &deadLetterWriter{path: path, maxSize: maxSize}
+}
+
+// Write appends a payload to the dead-letter file. The file is opened at
+// each write, as dead letters are expected to be rare.
+func (d *deadLetterWriter) Write(reason string, payload []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if info, err := os.Stat(d.path); err == nil && info.Size() >= d.maxSize {
+		if err := os.Rename(d.path, d.path+".1"); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(d.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	header := fmt.Sprintf("# %s %s\n",
+		time.Now().UTC().Format(time.RFC3339Nano),
+		strings.ReplaceAll(reason, "\n", " "))
+	_, err = file.Write([]byte(header))
+	if err == nil {
+		_, err = file.Write(payload)
+	}
+	if err == nil && (len(payload) == 0 || payload[len(payload)-1] != '\n') {
+		_, err = file.Write([]byte{'\n'})
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
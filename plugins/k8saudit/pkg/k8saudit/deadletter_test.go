@@ -0,0 +1,67 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestDeadLetterWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deadletter.log")
+	d := newDeadLetterWriter(path, 100)
+
+	// each payload is preceded by a header with the reason of the failure
+	if err := d.Write("bad\njson", []byte(`{"auditID":`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("schema", []byte("{}\n")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := regexp.MustCompile(`^# \S+ bad json\n\{"auditID":\n# \S+ schema\n\{\}\n$`)
+	if !expected.Match(data) {
+		t.Errorf("unexpected dead-letter file content: %q", data)
+	}
+
+	// the file is rotated once it exceeds its maximum size
+	if err := d.Write("oversize", make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("next", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := ioutil.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) < 100 {
+		t.Errorf("expected the rotated file to contain the previous payloads, got %d bytes", len(rotated))
+	}
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^# \S+ next\n\{\}\n$`).Match(data) {
+		t.Errorf("expected only the last payload after the rotation, got %q", data)
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dedupFlushInterval = time.Second
+	dedupEvictInterval = time.Minute
+	dedupCompactMin    = 10000
+)
+
+// dedupStore remembers the keys of the events already emitted for a given
+// time to live, so that duplicate events are discarded. The keys are
+// persisted in an append-only file in which each line is the expiration
+// time of a key in unix seconds, followed by the key itself. The file is
+// compacted once most of its lines refer to expired keys.
+type dedupStore struct {
+	path      string
+	ttl       time.Duration
+	mu        sync.Mutex
+	keys      map[string]int64
+	file      *os.File
+	writer    *bufio.Writer
+	lines     int
+	lastFlush time.Time
+	lastEvict time.Time
+}
+
+// openDedupStore opens the dedup store persisted in the given file,
+// creating it if needed. Keys that expired in the meantime are discarded.
+func openDedupStore(path string, ttl time.Duration) (*dedupStore, error) {
+	d := &dedupStore{
+		path:      path,
+		ttl:       ttl,
+		keys:      make(map[string]int64),
+		lastFlush: time.Now(),
+		lastEvict: time.Now(),
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	if err := d.compact(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Contains returns true if the given key has already been added and is not
+// expired yet
+func (d *dedupStore) Contains(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	exp, ok := d.keys[key]
+	return ok && exp > time.Now().Unix()
+}
+
+// Add remembers the given key for the time to live of the store
+func (d *dedupStore) Add(key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	exp := now.Add(d.ttl).Unix()
+	d.keys[key] = exp
+	d.lines++
+	if _, err := fmt.Fprintf(d.writer, "%d %s\n", exp, key); err != nil {
+		return err
+	}
+	if now.Sub(d.lastEvict) >= dedupEvictInterval {
+		d.evict(now)
+		d.lastEvict = now
+		if d.lines > dedupCompactMin && d.lines > 2*len(d.keys) {
+			return d.compact()
+		}
+	}
+	if now.Sub(d.lastFlush) >= dedupFlushInterval {
+		d.lastFlush = now
+		return d.writer.Flush()
+	}
+	return nil
+}
+
+// Close flushes the pending keys and closes the store file
+func (d *dedupStore) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.writer.Flush()
+	if closeErr := d.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (d *dedupStore) load() error {
+	file, err := os.Open(d.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	now := time.Now().Unix()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// ignore malformed lines, such as the ones partially written
+		parts := strings.SplitN(scanner.Text(), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		exp, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || exp <= now {
+			continue
+		}
+		d.keys[parts[1]] = exp
+	}
+	return scanner.Err()
+}
+
+func (d *dedupStore) evict(now time.Time) {
+	for key, exp := range d.keys {
+		if exp <= now.Unix() {
+			delete(d.keys, key)
+		}
+	}
+}
+
+// compact rewrites the store file with the live keys only, and keeps it
+// open for appending new keys. The new file atomically replaces the
+// current one, which is kept in use if compaction fails.
+func (d *dedupStore) compact() error {
+	if d.file != nil {
+		if err := d.writer.Flush(); err != nil {
+			return err
+		}
+	}
+	file, err := ioutil.TempFile(filepath.Dir(d.path), filepath.Base(d.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for key, exp := range d.keys {
+		fmt.Fprintf(writer, "%d %s\n", exp, key)
+	}
+	if err = writer.Flush(); err == nil {
+		if err = file.Sync(); err == nil {
+			err = os.Rename(file.Name(), d.path)
+		}
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if d.file != nil {
+		d.file.Close()
+	}
+	d.file = file
+	d.writer = writer
+	d.lines = len(d.keys)
+	return nil
+}
+
+// dedupKey returns the key identifying an audit event for deduplication,
+// or an empty string if the event can't be identified
+func dedupKey(ev *auditEvent) string {
+	auditID := ev.Data.GetStringBytes("auditID")
+	if len(auditID) == 0 {
+		return ""
+	}
+	return string(auditID) + "/" + string(ev.Data.GetStringBytes("stage"))
+}
@@ -0,0 +1,110 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/falcosecurity/plugin-sdk-go/pkg/sdk"
+	"github.com/valyala/fastjson"
+)
+
+func TestDedupStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+	d, err := openDedupStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Contains("a") {
+		t.Errorf("unexpected key in empty store")
+	}
+	if err := d.Add("a"); err != nil {
+		t.Fatal(err)
+	}
+	if !d.Contains("a") {
+		t.Errorf("expected added key to be contained")
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// keys are persisted, and compaction keeps the store writable
+	d, err = openDedupStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if !d.Contains("a") {
+		t.Errorf("expected key to be persisted")
+	}
+	if err := d.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Add("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(path); !strings.Contains(string(data), " b\n") {
+		t.Errorf("expected key to be written after compaction, got %q", data)
+	}
+}
+
+func TestDedupEmittedEvents(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.json")
+	var sb strings.Builder
+	for i := 0; i < 300; i++ {
+		sb.WriteString(testAuditEvent(fmt.Sprint(i)) + "\n")
+	}
+	// a duplicate of a queued event
+	sb.WriteString(testAuditEvent("299") + "\n")
+	if err := ioutil.WriteFile(path, []byte(sb.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := initTestPlugin(t, fmt.Sprintf(`{"dedupStorePath":%q,"batchSize":10}`, filepath.Join(dir, "dedup")))
+
+	// stop partway, while more events are queued in the source
+	src, err := p.OpenFilePath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := auditIDs(t, readTestEvents(t, p, src, 100))
+	src.(sdk.Closer).Close()
+
+	// only the events that have been emitted are discarded on replay
+	src, err = p.OpenFilePath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.(sdk.Closer).Close()
+	second := readTestEvents(t, p, src, 0)
+	for _, ev := range second {
+		if id := string(fastjson.MustParse(ev).GetStringBytes("auditID")); first[id] {
+			t.Errorf("event %s emitted twice", id)
+		}
+	}
+	if len(first)+len(second) != 300 {
+		t.Errorf("expected 300 events, got %d", len(first)+len(second))
+	}
+}
@@ -0,0 +1,288 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+const (
+	// enrichAnnotationPrefix is the prefix of the audit annotations
+	// injected by the plugin into each event
+	enrichAnnotationPrefix = "k8saudit.falcosecurity.org/"
+	//
+	// clusterNameAnnotation is the audit annotation containing the value of
+	// the clusterName init config
+	clusterNameAnnotation = enrichAnnotationPrefix + "cluster-name"
+	//
+	// labelAnnotationPrefix is the prefix of the audit annotations
+	// containing the static labels of the labels init config
+	labelAnnotationPrefix = enrichAnnotationPrefix + "label."
+	//
+	// ownerKindAnnotation and ownerNameAnnotation are the audit annotations
+	// containing the workload owning the pod targeted by the event
+	ownerKindAnnotation = enrichAnnotationPrefix + "owner-kind"
+	ownerNameAnnotation = enrichAnnotationPrefix + "owner-name"
+	//
+	// nodeNameAnnotation, nodeZoneAnnotation, and nodeRegionAnnotation are
+	// the audit annotations containing the node on which the pod targeted by
+	// the event is scheduled, and its topology labels
+	nodeNameAnnotation   = enrichAnnotationPrefix + "node-name"
+	nodeZoneAnnotation   = enrichAnnotationPrefix + "node-zone"
+	nodeRegionAnnotation = enrichAnnotationPrefix + "node-region"
+	//
+	// nodeZoneLabel and nodeRegionLabel are the well-known Kubernetes node
+	// labels that describe the failure domain of a node
+	nodeZoneLabel   = "topology.kubernetes.io/zone"
+	nodeRegionLabel = "topology.kubernetes.io/region"
+	//
+	// secretReferencedAnnotation is the audit annotation telling whether the
+	// secret targeted by the event is referenced by the pod performing the
+	// request
+	secretReferencedAnnotation = enrichAnnotationPrefix + "secret-referenced"
+	//
+	// podNameUserExtra is the user info extra key set by the API server for
+	// requests authenticated with a service account token bound to a pod
+	podNameUserExtra = "authentication.kubernetes.io/pod-name"
+	//
+	// serviceAccountUserPrefix is the prefix of the usernames of service accounts
+	serviceAccountUserPrefix = "system:serviceaccount:"
+)
+
+// enrichEvent injects the information configured in the plugin
+// configuration into the annotations of an audit event, so that it is
+// carried along with the event data and can be extracted as fields later on,
+// even when the event is replayed from a capture file. Returns true if the
+// event has been modified.
+func (k *Plugin) enrichEvent(value *fastjson.Value) bool {
+	var arena fastjson.Arena
+	var annotations *fastjson.Object
+	setAnnotation := func(key, val string) {
+		if annotations == nil {
+			if annotations = value.GetObject("annotations"); annotations == nil {
+				value.Set("annotations", arena.NewObject())
+				annotations = value.GetObject("annotations")
+			}
+		}
+		annotations.Set(key, arena.NewString(val))
+	}
+
+	if len(k.Config.ClusterName) > 0 {
+		setAnnotation(clusterNameAnnotation, k.Config.ClusterName)
+	}
+	if len(k.Config.Labels) > 0 {
+		// sort the keys so that the resulting JSON is deterministic
+		keys := make([]string, 0, len(k.Config.Labels))
+		for key := range k.Config.Labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			setAnnotation(labelAnnotationPrefix+key, k.Config.Labels[key])
+		}
+	}
+	if k.Config.EnrichNodes && k.kube != nil {
+		node, err := k.resolvePodNode(value)
+		if err != nil {
+			k.logger.Warnf("can't resolve pod node: %s", err.Error())
+			k.countError(kubeErrorCategory(err))
+		} else if node != nil {
+			setAnnotation(nodeNameAnnotation, node.Metadata.Name)
+			if zone, ok := node.Metadata.Labels[nodeZoneLabel]; ok {
+				setAnnotation(nodeZoneAnnotation, zone)
+			}
+			if region, ok := node.Metadata.Labels[nodeRegionLabel]; ok {
+				setAnnotation(nodeRegionAnnotation, region)
+			}
+		}
+	}
+	if k.Config.EnrichSecretAccess && k.kube != nil {
+		referenced, err := k.resolveSecretReferenced(value)
+		if err != nil {
+			k.logger.Warnf("can't resolve secret reference: %s", err.Error())
+			k.countError(kubeErrorCategory(err))
+		} else if len(referenced) > 0 {
+			setAnnotation(secretReferencedAnnotation, referenced)
+		}
+	}
+	if k.Config.EnrichOwners && k.kube != nil {
+		owner, err := k.resolvePodOwner(value)
+		if err != nil {
+			k.logger.Warnf("can't resolve pod owner: %s", err.Error())
+			k.countError(kubeErrorCategory(err))
+		} else if owner != nil {
+			setAnnotation(ownerKindAnnotation, owner.Kind)
+			setAnnotation(ownerNameAnnotation, owner.Name)
+		}
+	}
+	return annotations != nil
+}
+
+// removeEnrichAnnotations removes the annotations of an audit event having
+// the prefix of the ones injected by the plugin, so that they can't be
+// forged by the sender of the event, nor carried over from events chained
+// from another instance. Returns true if the event has been modified.
+func removeEnrichAnnotations(value *fastjson.Value) bool {
+	annotations := value.GetObject("annotations")
+	if annotations == nil {
+		return false
+	}
+	var keys []string
+	annotations.Visit(func(key []byte, v *fastjson.Value) {
+		if len(key) >= len(enrichAnnotationPrefix) && string(key[:len(enrichAnnotationPrefix)]) == enrichAnnotationPrefix {
+			keys = append(keys, string(key))
+		}
+	})
+	for _, key := range keys {
+		annotations.Del(key)
+	}
+	return len(keys) > 0
+}
+
+// resolvePodOwner returns the top-level workload owning the pod targeted by
+// an audit event, or nil if the event does not target a pod or if the pod
+// has no owner. Intermediate owners are followed, so that a pod created by
+// a ReplicaSet is resolved to its Deployment, and a pod created by a Job is
+// resolved to its CronJob.
+func (k *Plugin) resolvePodOwner(value *fastjson.Value) (*kubeOwnerReference, error) {
+	pod, err := k.eventPod(value)
+	if err != nil || pod == nil {
+		return nil, err
+	}
+
+	namespace := string(value.GetStringBytes("objectRef", "namespace"))
+	owner := pod.controller()
+	for owner != nil {
+		var path string
+		switch owner.Kind {
+		case "ReplicaSet":
+			path = fmt.Sprintf("/apis/apps/v1/namespaces/%s/replicasets/%s", url.PathEscape(namespace), url.PathEscape(owner.Name))
+		case "Job":
+			path = fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs/%s", url.PathEscape(namespace), url.PathEscape(owner.Name))
+		default:
+			return owner, nil
+		}
+		obj, ok := k.kube.Get(path)
+		if !ok {
+			// the owner is not cached yet, and is skipped until it is
+			return nil, nil
+		}
+		if obj == nil || obj.controller() == nil {
+			return owner, nil
+		}
+		owner = obj.controller()
+	}
+	return nil, nil
+}
+
+// resolveSecretReferenced returns "true" if the secret targeted by an
+// audit event is referenced by the pod performing the request, and "false"
+// otherwise. The requesting pod is known only for requests authenticated
+// with a service account token bound to a pod, and an empty string is
+// returned for all the other requests. An empty string is also returned if
+// the pod is not cached yet, since the lookup never blocks the event: the
+// first requests of a newly created pod are usually not enriched.
+func (k *Plugin) resolveSecretReferenced(value *fastjson.Value) (string, error) {
+	if string(value.GetStringBytes("objectRef", "resource")) != "secrets" {
+		return "", nil
+	}
+	secretName := string(value.GetStringBytes("objectRef", "name"))
+	secretNamespace := string(value.GetStringBytes("objectRef", "namespace"))
+	username := string(value.GetStringBytes("user", "username"))
+	podNames := value.GetArray("user", "extra", podNameUserExtra)
+	if len(secretName) == 0 || len(podNames) == 0 || !strings.HasPrefix(username, serviceAccountUserPrefix) {
+		return "", nil
+	}
+
+	// username is in the form system:serviceaccount:<namespace>:<name>
+	podNamespace := strings.Split(strings.TrimPrefix(username, serviceAccountUserPrefix), ":")[0]
+	if podNamespace != secretNamespace {
+		return "false", nil
+	}
+	podName := string(podNames[0].GetStringBytes())
+	pod, _ := k.kube.Get(fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", url.PathEscape(podNamespace), url.PathEscape(podName)))
+	if pod == nil {
+		return "", nil
+	}
+	if pod.referencesSecret(secretName) {
+		return "true", nil
+	}
+	return "false", nil
+}
+
+// resolvePodNode returns the node on which the pod targeted by an audit
+// event is scheduled, or nil if the event does not target a pod or if the
+// pod is not scheduled yet. For pods/binding requests, the node is the
+// target of the binding.
+func (k *Plugin) resolvePodNode(value *fastjson.Value) (*kubeObject, error) {
+	var nodeName string
+	if string(value.GetStringBytes("objectRef", "subresource")) == "binding" {
+		nodeName = string(value.GetStringBytes("requestObject", "target", "name"))
+	} else {
+		pod, err := k.eventPod(value)
+		if err != nil || pod == nil {
+			return nil, err
+		}
+		nodeName = pod.Spec.NodeName
+	}
+	if len(nodeName) == 0 {
+		return nil, nil
+	}
+	node, _ := k.kube.Get("/api/v1/nodes/" + url.PathEscape(nodeName))
+	return node, nil
+}
+
+// eventPod returns the definition of the pod targeted by an audit event,
+// or nil if the event does not target a pod. The pod definition is
+// available in the event in most cases, otherwise we fallback to the
+// objects retrieved from the API server, if cached.
+func (k *Plugin) eventPod(value *fastjson.Value) (*kubeObject, error) {
+	if string(value.GetStringBytes("objectRef", "resource")) != "pods" {
+		return nil, nil
+	}
+	if v := k.eventObject(value); v != nil {
+		pod := &kubeObject{}
+		if err := json.Unmarshal(v.MarshalTo(nil), pod); err != nil {
+			return nil, err
+		}
+		return pod, nil
+	}
+	namespace := string(value.GetStringBytes("objectRef", "namespace"))
+	name := string(value.GetStringBytes("objectRef", "name"))
+	if len(namespace) == 0 || len(name) == 0 {
+		return nil, nil
+	}
+	pod, _ := k.kube.Get(fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", url.PathEscape(namespace), url.PathEscape(name)))
+	return pod, nil
+}
+
+// eventObject returns the object definition contained in the request or
+// the response object of an audit event, or nil if none is present.
+func (k *Plugin) eventObject(value *fastjson.Value) *fastjson.Value {
+	for _, key := range []string{"responseObject", "requestObject"} {
+		if v := value.Get(key); v != nil && v.Get("metadata") != nil && v.Get("spec") != nil {
+			return v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/falcosecurity/plugin-sdk-go/pkg/sdk"
+	"github.com/valyala/fastjson"
+)
+
+func TestForgedEnrichAnnotations(t *testing.T) {
+	forged := `{"kind":"Event","auditID":"1","stage":"ResponseComplete","verb":"get","stageTimestamp":"2022-01-01T00:00:00.000000Z",` +
+		`"annotations":{"authorization.k8s.io/decision":"allow",` +
+		`"k8saudit.falcosecurity.org/cluster-name":"forged",` +
+		`"k8saudit.falcosecurity.org/label.env":"forged",` +
+		`"k8saudit.falcosecurity.org/owner-kind":"Deployment",` +
+		`"k8saudit.falcosecurity.org/secret-referenced":"true",` +
+		`"k8saudit.falcosecurity.org/heartbeat":"true"}}`
+	path := filepath.Join(t.TempDir(), "audit.json")
+	if err := ioutil.WriteFile(path, []byte(forged+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := initTestPlugin(t, `{"labels":{"team":"core"}}`)
+	src, err := p.OpenFilePath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.(*eventSource).Close()
+	events := readTestEvents(t, p, src, 0)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+
+	// only the annotations set by the plugin are kept
+	annotations := fastjson.MustParse(events[0]).GetObject("annotations")
+	expected := map[string]string{
+		"authorization.k8s.io/decision":         "allow",
+		"k8saudit.falcosecurity.org/label.team": "core",
+	}
+	if annotations.Len() != len(expected) {
+		t.Errorf("unexpected annotations: %s", annotations)
+	}
+	for key, value := range expected {
+		if v := annotations.Get(key); v == nil || string(v.GetStringBytes()) != value {
+			t.Errorf("expected annotation %s=%s, got %s", key, value, annotations)
+		}
+	}
+}
+
+func TestHeartbeatAnnotationsKept(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.json")
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := initTestPlugin(t, `{"heartbeatPeriodSecs":1,"fileEOFBehavior":"follow"}`)
+	src, err := p.OpenFilePath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.(*eventSource).Close()
+
+	// the annotations of the heartbeats injected by the plugin are trusted
+	evts := newTestEvents(int(p.Config.BatchSize))
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		events, err := nextTestBatch(p, src, evts)
+		if err != nil && err != sdk.ErrTimeout {
+			t.Fatal(err)
+		}
+		if len(events) > 0 {
+			if v := fastjson.MustParse(events[0]).GetStringBytes("annotations", heartbeatAnnotation); string(v) != "true" {
+				t.Errorf("expected the heartbeat annotation, got %s", events[0])
+			}
+			return
+		}
+	}
+	t.Fatal("timed out waiting for a heartbeat")
+}
@@ -0,0 +1,84 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// The categories in which the failures of the plugin are counted
+const (
+	errorCategoryTransport = "transport"
+	errorCategoryAuth      = "auth"
+	errorCategoryJSONParse = "json_parse"
+	errorCategorySchema    = "schema"
+	errorCategoryOversize  = "oversize"
+	errorCategoryOverflow  = "overflow"
+)
+
+// maxBytesErrorMsg is the error message returned when reading a request
+// body limited by http.MaxBytesReader over its limit
+const maxBytesErrorMsg = "http: request body too large"
+
+// kubeStatusError is returned when the Kubernetes API server responds
+// with an unexpected status code
+type kubeStatusError struct {
+	path   string
+	status string
+	code   int
+}
+
+func (e *kubeStatusError) Error() string {
+	return "unexpected response from Kubernetes API server for " + e.path + ": " + e.status
+}
+
+// countError increments the failure counter of the given category
+func (k *Plugin) countError(category string) {
+	k.metrics.errors.Add(1, category)
+}
+
+// readErrorCategory returns the category of an error occurred reading
+// the body of a webhook request
+func readErrorCategory(err error) string {
+	if strings.Contains(err.Error(), maxBytesErrorMsg) {
+		return errorCategoryOversize
+	}
+	return errorCategoryTransport
+}
+
+// decodeErrorCategory returns the category of an error occurred decoding
+// the JSON messages of a file
+func decodeErrorCategory(err error) string {
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return errorCategoryJSONParse
+	}
+	return errorCategoryTransport
+}
+
+// kubeErrorCategory returns the category of an error occurred querying
+// the Kubernetes API server
+func kubeErrorCategory(err error) string {
+	if statusErr, ok := err.(*kubeStatusError); ok {
+		if statusErr.code == http.StatusUnauthorized || statusErr.code == http.StatusForbidden {
+			return errorCategoryAuth
+		}
+	}
+	return errorCategoryTransport
+}
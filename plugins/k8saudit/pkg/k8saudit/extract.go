@@ -17,13 +17,17 @@ limitations under the License.
 package k8saudit
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/url"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/falcosecurity/plugin-sdk-go/pkg/sdk"
+	"github.com/itchyny/gojq"
 	"github.com/valyala/fastjson"
 )
 
@@ -31,6 +35,43 @@ const (
 	noIndexFilter = -1
 )
 
+// verbCategories maps the Kubernetes API verbs to coarse-grained
+// categories, for rules that only care about the class of a mutation
+var verbCategories = map[string]string{
+	"get":              "read",
+	"list":             "read",
+	"watch":            "read",
+	"create":           "write",
+	"update":           "write",
+	"patch":            "write",
+	"delete":           "delete",
+	"deletecollection": "delete",
+	"impersonate":      "impersonate",
+	"escalate":         "escalate",
+	"bind":             "escalate",
+}
+
+// sensitiveHostPaths are the host paths that should never be mounted by a pod
+// except by trusted system components, because they allow tampering with the
+// node or with the container runtime
+var sensitiveHostPaths = []string{
+	"/",
+	"/etc",
+	"/proc",
+	"/sys",
+	"/dev",
+	"/root",
+	"/var/log",
+	"/var/lib/docker",
+	"/var/run/docker.sock",
+	"/var/run/containerd",
+	"/run/containerd",
+	"/var/run/crio",
+	"/var/lib/kubelet",
+	"/var/lib/etcd",
+	"/etc/kubernetes",
+}
+
 var (
 	// ErrExtractNotAvailable indicates that the requested field cannot be
 	// extracted from a certain event due to some value not being available
@@ -66,34 +107,47 @@ func (k *Plugin) Extract(req sdk.ExtractRequest, evt sdk.EventReader) error {
 	return err
 }
 
-// Decode parses a JSON value from an io.ReadSeeker
+// DecodeReader parses a JSON value from an io.ReadSeeker. The parsed value
+// is cached by event number, so that extracting many fields from the same
+// event only parses its payload once, and events from which no field is
+// extracted are never parsed at all. The returned value is valid until
+// the next invocation of DecodeReader with a different event number.
 func (e *Plugin) DecodeReader(evtNum uint64, reader io.ReadSeeker) (*fastjson.Value, error) {
-	// as a very quick sanity check, only try to extract all if
-	// the first character is '{' or '['
-	data := []byte{0}
-	_, err := reader.Read(data)
+	// return the cached value, if we already decoded this event
+	if e.jdata != nil && evtNum == e.jdataEvtnum {
+		return e.jdata, nil
+	}
+
+	// read the event payload, reusing the buffer of the previous events
+	_, err := reader.Seek(0, io.SeekStart)
 	if err != nil {
 		return nil, err
 	}
+	buf := bytes.NewBuffer(e.jdataBuf[:0])
+	if _, err = buf.ReadFrom(reader); err != nil {
+		return nil, err
+	}
+	e.jdataBuf = buf.Bytes()
+
+	// as a very quick sanity check, only try to extract all if
+	// the first character is '{' or '['
+	data := e.jdataBuf
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
 	if !(data[0] == '{' || data[0] == '[') {
 		return nil, ErrExtractBrokenJSON
 	}
-	// decode the json, but only if we haven't done it yet for this event
-	if evtNum != e.jdataEvtnum {
-		_, err := reader.Seek(0, io.SeekStart)
-		if err != nil {
-			return nil, err
-		}
-		data, err = ioutil.ReadAll(reader)
-		if err != nil {
-			return nil, err
-		}
-		e.jdata, err = e.jparser.ParseBytes(data)
-		if err != nil {
-			return nil, err
-		}
-		e.jdataEvtnum = evtNum
+
+	// decode the json and cache it for the next extractions. The parser
+	// copies the data, so the buffer can be reused right away
+	e.jqInput = nil
+	e.jdata, err = e.jparser.ParseBytes(data)
+	if err != nil {
+		e.jdata = nil
+		return nil, err
 	}
+	e.jdataEvtnum = evtNum
 	return e.jdata, nil
 }
 
@@ -113,45 +167,134 @@ func (e *Plugin) ExtractFromEvent(req sdk.ExtractRequest, evt sdk.EventReader) e
 }
 
 // ExtractFromJSON processes a sdk.ExtractRequest and extracts a
-// field by reading data from a jsonValue *fastjson.Value
+// field by reading data from a jsonValue *fastjson.Value. The field is
+// identified by its name. Plugins embedding this extractor can have their
+// own list of fields, so the ID of the request is only used as a shortcut
+// when it is the index of a field with the same name in Fields().
 func (e *Plugin) ExtractFromJSON(req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 	// discard unrelated JSONs events
 	if jsonValue.Get("auditID") == nil {
 		return ErrExtractNotAvailable
 	}
-	switch req.Field() {
-	case "ka.auditid":
+	if id := req.FieldID(); id < uint64(len(fieldExtractorsByID)) && fieldExtractorsByID[id].name == req.Field() {
+		return fieldExtractorsByID[id].extract(e, req, jsonValue)
+	}
+	if extract, ok := fieldExtractors[req.Field()]; ok {
+		return extract(e, req, jsonValue)
+	}
+	return fmt.Errorf("unsupported extraction field: %s", req.Field())
+}
+
+// fieldExtractor extracts the value of a field from the JSON value of a
+// K8S Audit event, and sets it in the extraction request
+type fieldExtractor func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error
+
+// namedFieldExtractor is the extractor of a field, along with its name
+type namedFieldExtractor struct {
+	name    string
+	extract fieldExtractor
+}
+
+// fieldExtractorsByID contains the extractor of each supported field,
+// indexed by field ID. The table is built once, so that the requests of
+// this plugin are dispatched without looking up the field names.
+var fieldExtractorsByID = func() []namedFieldExtractor {
+	fields := (&Plugin{}).Fields()
+	res := make([]namedFieldExtractor, len(fields))
+	for i, field := range fields {
+		res[i] = namedFieldExtractor{name: field.Name, extract: fieldExtractors[field.Name]}
+		if res[i].extract == nil {
+			res[i].extract = unsupportedFieldExtractor
+		}
+	}
+	return res
+}()
+
+func unsupportedFieldExtractor(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+	return fmt.Errorf("unsupported extraction field: %s", req.Field())
+}
+
+// fieldExtractors maps the name of each supported field to its extractor
+var fieldExtractors = map[string]fieldExtractor{
+	"ka.auditid": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "auditID")
-	case "ka.stage":
+	},
+	"ka.stage": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "stage")
-	case "ka.auth.decision":
+	},
+	"ka.annotations": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "annotations", req.ArgKey())
+	},
+	"ka.jq": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractJQ(req, jsonValue, req.ArgKey())
+	},
+	"ka.cluster.name": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "annotations", clusterNameAnnotation)
+	},
+	"ka.label": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "annotations", labelAnnotationPrefix+req.ArgKey())
+	},
+	"ka.auth.decision": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "annotations", "authorization.k8s.io/decision")
-	case "ka.auth.reason":
+	},
+	"ka.auth.reason": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "annotations", "authorization.k8s.io/reason")
-	case "ka.user.name":
+	},
+	"ka.psa.enforce_policy": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "annotations", "pod-security.kubernetes.io/enforce-policy")
+	},
+	"ka.psa.audit_violations": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "annotations", "pod-security.kubernetes.io/audit-violations")
+	},
+	"ka.psa.exempt": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "annotations", "pod-security.kubernetes.io/exempt")
+	},
+	"ka.api.deprecated": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "annotations", "k8s.io/deprecated")
+	},
+	"ka.api.removed_release": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "annotations", "k8s.io/removed-release")
+	},
+	"ka.user.name": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "user", "username")
-	case "ka.user.groups":
+	},
+	"ka.user.groups": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "user", "groups")
-	case "ka.impuser.name":
+	},
+	"ka.impuser.name": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "impersonatedUser", "username")
-	case "ka.verb":
-		return e.extractFromKeys(req, jsonValue, "verb")
-	case "ka.uri":
-		return e.extractFromKeys(req, jsonValue, "requestURI")
-	case "ka.uri.param":
-		uriValue := jsonValue.Get("requestURI")
-		if uriValue == nil {
-			return ErrExtractNotAvailable
-		}
-		uriString, err := e.jsonValueAsString(uriValue)
+	},
+	"ka.impgroups": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "impersonatedUser", "groups")
+	},
+	"ka.sourceips": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		arr, err := e.getValuesRecursive(jsonValue, e.argIndexFilter(req), "sourceIPs", "")
 		if err != nil {
 			return err
 		}
-		uri, err := url.Parse(uriString)
-		if err != nil {
-			return err
+		req.SetValue(e.arrayAsStringsSkipNil(arr))
+		return nil
+	},
+	"ka.verb": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "verb")
+	},
+	"ka.verb.category": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		verb := jsonValue.Get("verb")
+		if verb == nil {
+			return ErrExtractNotAvailable
+		}
+		category, ok := verbCategories[string(verb.GetStringBytes())]
+		if !ok {
+			category = "other"
 		}
-		query, err := url.ParseQuery(uri.RawQuery)
+		req.SetValue(category)
+		return nil
+	},
+	"ka.uri": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "requestURI")
+	},
+	"ka.uri.param": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		query, err := e.readURIQuery(jsonValue)
 		if err != nil {
 			return err
 		}
@@ -159,74 +302,231 @@ func (e *Plugin) ExtractFromJSON(req sdk.ExtractRequest, jsonValue *fastjson.Val
 		if len(param) > 0 {
 			req.SetValue(param[0])
 		}
-	case "ka.target.name":
+		return nil
+	},
+	"ka.req.exec.command": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		query, err := e.readURIQuery(jsonValue)
+		if err != nil {
+			return err
+		}
+		if len(query["command"]) == 0 {
+			return ErrExtractNotAvailable
+		}
+		req.SetValue(strings.Join(query["command"], " "))
+		return nil
+	},
+	"ka.req.exec.container": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractURIQueryParam(req, jsonValue, "container")
+	},
+	"ka.req.exec.tty": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractURIQueryParam(req, jsonValue, "tty")
+	},
+	"ka.req.exec.stdin": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractURIQueryParam(req, jsonValue, "stdin")
+	},
+	"ka.target.name": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "objectRef", "name")
-	case "ka.target.namespace":
+	},
+	"ka.target.namespace": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "objectRef", "namespace")
-	case "ka.target.resource":
+	},
+	"ka.target.resource": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "objectRef", "resource")
-	case "ka.target.subresource":
+	},
+	"ka.target.subresource": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "objectRef", "subresource")
-	case "ka.req.binding.subjects":
+	},
+	"ka.target.apigroup": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "objectRef", "apiGroup")
+	},
+	"ka.target.apiversion": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "objectRef", "apiVersion")
+	},
+	"ka.target.uid": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "objectRef", "uid")
+	},
+	"ka.target.owner.kind": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "annotations", ownerKindAnnotation)
+	},
+	"ka.target.owner.name": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "annotations", ownerNameAnnotation)
+	},
+	"ka.target.node.name": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "annotations", nodeNameAnnotation)
+	},
+	"ka.target.node.zone": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "annotations", nodeZoneAnnotation)
+	},
+	"ka.target.node.region": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "annotations", nodeRegionAnnotation)
+	},
+	"ka.req.obj": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		keys := append([]string{"requestObject"}, e.jsonPointerKeys(req.ArgKey())...)
+		return e.extractFromKeys(req, jsonValue, keys...)
+	},
+	"ka.req.obj.labels": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "requestObject", "metadata", "labels", req.ArgKey())
+	},
+	"ka.req.obj.annotations": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "requestObject", "metadata", "annotations", req.ArgKey())
+	},
+	"ka.req.binding.subjects": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "requestObject", "subjects")
-	case "ka.req.binding.role":
+	},
+	"ka.req.binding.role": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "requestObject", "roleRef", "name")
-	case "ka.req.binding.subject.has_name":
+	},
+	"ka.req.binding.role.kind": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "requestObject", "roleRef", "kind")
+	},
+	"ka.req.binding.subject.names": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		arr, err := e.getValuesRecursive(jsonValue, e.argIndexFilter(req), "requestObject", "subjects", "name")
+		if err != nil {
+			return err
+		}
+		req.SetValue(e.arrayAsStringsSkipNil(arr))
+		return nil
+	},
+	"ka.req.binding.subject.kinds": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		arr, err := e.getValuesRecursive(jsonValue, e.argIndexFilter(req), "requestObject", "subjects", "kind")
+		if err != nil {
+			return err
+		}
+		req.SetValue(e.arrayAsStringsSkipNil(arr))
+		return nil
+	},
+	"ka.req.binding.subject.has_name": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		// note(jasondellaluce): this is documented to return N/A, however
 		// the original K8S Audit implementation returns true here
 		req.SetValue("true")
-	case "ka.req.configmap.name":
+		return nil
+	},
+	"ka.req.token.audiences": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "requestObject", "spec", "audiences")
+	},
+	"ka.req.token.expiration_seconds": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "requestObject", "spec", "expirationSeconds")
+	},
+	"ka.req.csr.signer_name": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "requestObject", "spec", "signerName")
+	},
+	"ka.req.csr.usages": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "requestObject", "spec", "usages")
+	},
+	"ka.req.csr.conditions": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		arr, err := e.getValuesRecursive(jsonValue, e.argIndexFilter(req), "requestObject", "status", "conditions", "type")
+		if err != nil {
+			return err
+		}
+		req.SetValue(e.arrayAsStringsSkipNil(arr))
+		return nil
+	},
+	"ka.secret.type": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		for _, key := range []string{"requestObject", "responseObject"} {
+			if jsonValue.Get(key, "type") != nil {
+				return e.extractFromKeys(req, jsonValue, key, "type")
+			}
+		}
+		return ErrExtractNotAvailable
+	},
+	"ka.secret.referenced": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "annotations", secretReferencedAnnotation)
+	},
+	"ka.req.configmap.name": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "objectRef", "name")
-	case "ka.req.configmap.obj":
+	},
+	"ka.req.configmap.obj": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "requestObject", "data")
-	case "ka.req.pod.containers.image":
+	},
+	"ka.req.pod.containers.image": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		indexFilter := e.argIndexFilter(req)
 		images, err := e.readContainerImages(jsonValue, indexFilter)
 		if err != nil {
 			return err
 		}
 		req.SetValue(images)
-	case "ka.req.pod.containers.image.repository":
+		return nil
+	},
+	"ka.req.pod.containers.image.repository": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		indexFilter := e.argIndexFilter(req)
 		repos, err := e.readContainerRepositories(jsonValue, indexFilter)
 		if err != nil {
 			return err
 		}
 		req.SetValue(repos)
-	case "ka.req.container.image":
+		return nil
+	},
+	"ka.req.pod.init_containers.image": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		arr, err := e.getValuesRecursive(jsonValue, e.argIndexFilter(req), "requestObject", "spec", "initContainers", "image")
+		if err != nil {
+			return err
+		}
+		req.SetValue(e.arrayAsStringsSkipNil(arr))
+		return nil
+	},
+	"ka.req.pod.containers.image.registry": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractImageRefComponent(req, jsonValue, func(r *imageRef) string { return r.Registry })
+	},
+	"ka.req.pod.containers.image.tag": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractImageRefComponent(req, jsonValue, func(r *imageRef) string { return r.Tag })
+	},
+	"ka.req.pod.containers.image.digest": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractImageRefComponent(req, jsonValue, func(r *imageRef) string { return r.Digest })
+	},
+	"ka.req.container.image": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		images, err := e.readContainerImages(jsonValue, 0)
 		if err != nil {
 			return err
 		}
 		req.SetValue(images[0])
-	case "ka.req.container.image.repository":
+		return nil
+	},
+	"ka.req.container.image.repository": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		repos, err := e.readContainerRepositories(jsonValue, 0)
 		if err != nil {
 			return err
 		}
 		req.SetValue(repos[0])
-	case "ka.req.pod.host_ipc":
+		return nil
+	},
+	"ka.req.pod.node_name": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		// pods/binding requests contain a Binding object, whereas pods
+		// can also be created with a node name already set in their spec
+		if string(jsonValue.GetStringBytes("objectRef", "subresource")) == "binding" {
+			return e.extractFromKeys(req, jsonValue, "requestObject", "target", "name")
+		}
+		return e.extractFromKeys(req, jsonValue, "requestObject", "spec", "nodeName")
+	},
+	"ka.req.pod.host_ipc": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "requestObject", "spec", "hostIPC")
-	case "ka.req.pod.host_network":
+	},
+	"ka.req.pod.host_network": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "requestObject", "spec", "hostNetwork")
-	case "ka.req.container.host_network":
+	},
+	"ka.req.container.host_network": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "requestObject", "spec", "hostNetwork")
-	case "ka.req.pod.host_pid":
+	},
+	"ka.req.pod.host_pid": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "requestObject", "spec", "hostPID")
-	case "ka.req.pod.containers.host_port":
+	},
+	"ka.req.pod.containers.host_port": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		indexFilter := e.argIndexFilter(req)
 		values, err := e.readContainerHostPorts(jsonValue, indexFilter)
 		if err != nil {
 			return err
 		}
 		req.SetValue(values)
-	case "ka.req.pod.containers.privileged":
+		return nil
+	},
+	"ka.req.pod.containers.privileged": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		arr, err := e.getValuesRecursive(jsonValue, e.argIndexFilter(req), "requestObject", "spec", "containers", "securityContext", "privileged")
 		if err != nil {
 			return err
 		}
 		req.SetValue(e.arrayAsStringsSkipNil(arr))
-	case "ka.req.container.privileged":
+		return nil
+	},
+	"ka.req.container.privileged": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		arr, err := e.getValuesRecursive(jsonValue, noIndexFilter, "requestObject", "spec", "containers", "securityContext", "privileged")
 		if err != nil {
 			return err
@@ -238,84 +538,141 @@ func (e *Plugin) ExtractFromJSON(req sdk.ExtractRequest, jsonValue *fastjson.Val
 			}
 		}
 		req.SetValue("false")
-	case "ka.req.pod.containers.allow_privilege_escalation":
+		return nil
+	},
+	"ka.req.pod.containers.allow_privilege_escalation": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		arr, err := e.getValuesRecursive(jsonValue, e.argIndexFilter(req), "requestObject", "spec", "containers", "securityContext", "allowPrivilegeEscalation")
 		if err != nil {
 			return err
 		}
 		req.SetValue(e.arrayAsStringsSkipNil(arr))
-	case "ka.req.pod.containers.read_only_fs":
+		return nil
+	},
+	"ka.req.pod.containers.read_only_fs": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		arr, err := e.getValuesRecursive(jsonValue, e.argIndexFilter(req), "requestObject", "spec", "containers", "securityContext", "readOnlyRootFilesystem")
 		if err != nil {
 			return err
 		}
 		req.SetValue(e.arrayAsStringsSkipNil(arr))
-	case "ka.req.pod.run_as_user":
+		return nil
+	},
+	"ka.req.pod.run_as_user": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "requestObject", "spec", "securityContext", "runAsUser")
-	case "ka.req.pod.containers.run_as_user":
+	},
+	"ka.req.pod.containers.run_as_user": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		arr, err := e.getValuesRecursive(jsonValue, e.argIndexFilter(req), "requestObject", "spec", "containers", "securityContext", "runAsUser")
 		if err != nil {
 			return err
 		}
 		req.SetValue(e.arrayAsStringsSkipNil(arr))
-	case "ka.req.pod.containers.eff_run_as_user":
+		return nil
+	},
+	"ka.req.pod.containers.eff_run_as_user": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		indexFilter := e.argIndexFilter(req)
 		values, err := e.readFromContainerEffectively(jsonValue, indexFilter, "runAsUser")
 		if err != nil {
 			return err
 		}
 		req.SetValue(values)
-	case "ka.req.pod.run_as_group":
+		return nil
+	},
+	"ka.req.pod.run_as_non_root": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "requestObject", "spec", "securityContext", "runAsNonRoot")
+	},
+	"ka.req.pod.containers.run_as_non_root": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		arr, err := e.getValuesRecursive(jsonValue, e.argIndexFilter(req), "requestObject", "spec", "containers", "securityContext", "runAsNonRoot")
+		if err != nil {
+			return err
+		}
+		req.SetValue(e.arrayAsStringsSkipNil(arr))
+		return nil
+	},
+	"ka.req.pod.run_as_group": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "requestObject", "spec", "securityContext", "runAsGroup")
-	case "ka.req.pod.containers.run_as_group":
+	},
+	"ka.req.pod.containers.run_as_group": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		arr, err := e.getValuesRecursive(jsonValue, e.argIndexFilter(req), "requestObject", "spec", "containers", "securityContext", "runAsGroup")
 		if err != nil {
 			return err
 		}
 		req.SetValue(e.arrayAsStringsSkipNil(arr))
-	case "ka.req.pod.containers.eff_run_as_group":
+		return nil
+	},
+	"ka.req.pod.containers.eff_run_as_group": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		indexFilter := e.argIndexFilter(req)
 		values, err := e.readFromContainerEffectively(jsonValue, indexFilter, "runAsGroup")
 		if err != nil {
 			return err
 		}
 		req.SetValue(values)
-	case "ka.req.pod.containers.proc_mount":
+		return nil
+	},
+	"ka.req.pod.containers.proc_mount": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		arr, err := e.getValuesRecursive(jsonValue, e.argIndexFilter(req), "requestObject", "spec", "containers", "securityContext", "procMount")
 		if err != nil {
 			return err
 		}
 		req.SetValue(e.arrayAsStringsSkipNil(arr))
-	case "ka.req.role.rules":
+		return nil
+	},
+	"ka.req.role.rules": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "requestObject", "rules")
-	case "ka.req.role.rules.apiGroups":
+	},
+	"ka.req.role.rules.apiGroups": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractRulesField(req, jsonValue, "apiGroups")
-	case "ka.req.role.rules.nonResourceURLs":
+	},
+	"ka.req.role.rules.nonResourceURLs": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractRulesField(req, jsonValue, "nonResourceURLs")
-	case "ka.req.role.rules.verbs":
+	},
+	"ka.req.role.rules.verbs": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractRulesField(req, jsonValue, "verbs")
-	case "ka.req.role.rules.resources":
+	},
+	"ka.req.role.rules.resources": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractRulesField(req, jsonValue, "resources")
-	case "ka.req.pod.fs_group":
+	},
+	"ka.req.pod.fs_group": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "requestObject", "spec", "securityContext", "fsGroup")
-	case "ka.req.pod.supplemental_groups":
+	},
+	"ka.req.pod.supplemental_groups": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "requestObject", "spec", "securityContext", "supplementalGroups")
-	case "ka.req.pod.containers.add_capabilities":
+	},
+	"ka.req.pod.containers.add_capabilities": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		arr, err := e.getValuesRecursive(jsonValue, e.argIndexFilter(req), "requestObject", "spec", "containers", "securityContext", "capabilities", "add")
 		if err != nil {
 			return err
 		}
 		req.SetValue(e.arrayAsStringsSkipNil(arr))
-	case "ka.req.service.type":
+		return nil
+	},
+	"ka.req.pod.containers.drop_capabilities": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		// the capabilities of all the containers are flattened in a
+		// single list, so that rules can match them with in/intersects
+		arr, err := e.getValuesRecursive(jsonValue, e.argIndexFilter(req), "requestObject", "spec", "containers", "securityContext", "capabilities", "drop")
+		if err != nil {
+			return err
+		}
+		var values []string
+		for _, v := range arr {
+			if v != nil && v.Type() == fastjson.TypeArray {
+				values = append(values, e.arrayAsStringsSkipNil(v.GetArray())...)
+			}
+		}
+		req.SetValue(values)
+		return nil
+	},
+	"ka.req.service.type": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "requestObject", "spec", "type")
-	case "ka.req.service.ports":
+	},
+	"ka.req.service.ports": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		indexFilter := e.argIndexFilter(req)
 		arr, err := e.getValuesRecursive(jsonValue, indexFilter, "requestObject", "spec", "ports")
 		if err != nil {
 			return err
 		}
 		req.SetValue(e.arrayAsStringsSkipNil(arr))
-	case "ka.req.volume.hostpath":
+		return nil
+	},
+	"ka.req.volume.hostpath": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		arr, err := e.getValuesRecursive(jsonValue, e.argIndexFilter(req), "requestObject", "spec", "volumes", "hostPath", "path")
 		if err != nil {
 			return err
@@ -333,19 +690,45 @@ func (e *Plugin) ExtractFromJSON(req sdk.ExtractRequest, jsonValue *fastjson.Val
 			}
 		}
 		req.SetValue("false")
-	case "ka.req.pod.volumes.hostpath":
+		return nil
+	},
+	"ka.req.networkpolicy.ingress_open": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractNetworkPolicyOpen(req, jsonValue, "ingress", "from")
+	},
+	"ka.req.networkpolicy.egress_open": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractNetworkPolicyOpen(req, jsonValue, "egress", "to")
+	},
+	"ka.req.pod.volumes.hostpath": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		arr, err := e.getValuesRecursive(jsonValue, e.argIndexFilter(req), "requestObject", "spec", "volumes", "hostPath", "path")
 		if err != nil {
 			return err
 		}
 		req.SetValue(e.arrayAsStringsSkipNil(arr))
-	case "ka.req.pod.volumes.flexvolume_driver":
+		return nil
+	},
+	"ka.req.pod.volumes.sensitive_hostpath": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		arr, err := e.getValuesRecursive(jsonValue, noIndexFilter, "requestObject", "spec", "volumes", "hostPath", "path")
+		if err != nil {
+			return err
+		}
+		for _, v := range e.arrayAsStringsSkipNil(arr) {
+			if e.isSensitiveHostPath(v) {
+				req.SetValue("true")
+				return nil
+			}
+		}
+		req.SetValue("false")
+		return nil
+	},
+	"ka.req.pod.volumes.flexvolume_driver": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		arr, err := e.getValuesRecursive(jsonValue, e.argIndexFilter(req), "requestObject", "spec", "volumes", "flexVolume", "driver")
 		if err != nil {
 			return err
 		}
 		req.SetValue(e.arrayAsStringsSkipNil(arr))
-	case "ka.req.pod.volumes.volume_type":
+		return nil
+	},
+	"ka.req.pod.volumes.volume_type": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		indexFilter := e.argIndexFilter(req)
 		arr, err := e.getValuesRecursive(jsonValue, indexFilter, "requestObject", "spec", "volumes", "")
 		if err != nil {
@@ -368,18 +751,63 @@ func (e *Plugin) ExtractFromJSON(req sdk.ExtractRequest, jsonValue *fastjson.Val
 			}
 		}
 		req.SetValue(values)
-	case "ka.resp.name":
+		return nil
+	},
+	"ka.resp.name": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "responseObject", "metadata", "name")
-	case "ka.response.code":
+	},
+	"ka.resp.obj": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		keys := append([]string{"responseObject"}, e.jsonPointerKeys(req.ArgKey())...)
+		return e.extractFromKeys(req, jsonValue, keys...)
+	},
+	"ka.response.code": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "responseStatus", "code")
+	},
+	// ka.response.code is kept as a string for the rules using string
+	// operators on it, and ka.response.code_num exposes it as a number
+	"ka.response.code_num": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "responseStatus", "code")
-	case "ka.response.reason":
+	},
+	"ka.response.reason": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "responseStatus", "reason")
-	case "ka.useragent":
+	},
+	"ka.response.message": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		return e.extractFromKeys(req, jsonValue, "responseStatus", "message")
+	},
+	"ka.latency": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		received, err := e.readTimestamp(jsonValue, "requestReceivedTimestamp")
+		if err != nil {
+			return err
+		}
+		stage, err := e.readTimestamp(jsonValue, "stageTimestamp")
+		if err != nil {
+			return err
+		}
+		if stage.Before(received) {
+			return ErrExtractNotAvailable
+		}
+		req.SetValue(uint64(stage.Sub(received).Milliseconds()))
+		return nil
+	},
+	"ka.useragent": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
 		return e.extractFromKeys(req, jsonValue, "userAgent")
-	default:
-		return fmt.Errorf("unsupported extraction field: %s", req.Field())
-	}
-	return nil
+	},
+	"ka.heartbeat": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		req.SetValue(fmt.Sprintf("%v", jsonValue.Get("annotations", heartbeatAnnotation) != nil))
+		return nil
+	},
+	"ka.plugin.events_received": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		req.SetValue(e.metrics.eventsParsed.Sum())
+		return nil
+	},
+	"ka.plugin.events_dropped": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		req.SetValue(e.metrics.eventsDropped.Sum() + e.metrics.messagesDropped.Sum())
+		return nil
+	},
+	"ka.plugin.queue_depth": func(e *Plugin, req sdk.ExtractRequest, jsonValue *fastjson.Value) error {
+		req.SetValue(e.metrics.QueueDepth())
+		return nil
+	},
 }
 
 func (e *Plugin) argIndexFilter(req sdk.ExtractRequest) int {
@@ -481,6 +909,19 @@ func (e *Plugin) readContainerRepositories(jsonValue *fastjson.Value, indexFilte
 	return repos, nil
 }
 
+func (e *Plugin) extractImageRefComponent(req sdk.ExtractRequest, jsonValue *fastjson.Value, component func(*imageRef) string) error {
+	images, err := e.readContainerImages(jsonValue, e.argIndexFilter(req))
+	if err != nil {
+		return err
+	}
+	var values []string
+	for _, image := range images {
+		values = append(values, component(parseImageRef(image)))
+	}
+	req.SetValue(values)
+	return nil
+}
+
 func (e *Plugin) readContainerHostPorts(jsonValue *fastjson.Value, indexFilter int) ([]string, error) {
 	containersPorts, err := e.getValuesRecursive(jsonValue, indexFilter, "requestObject", "spec", "containers", "ports")
 	if err != nil {
@@ -530,6 +971,90 @@ func (e *Plugin) readFromContainerEffectively(jsonValue *fastjson.Value, indexFi
 	return e.arrayAsStringsWithDefault(arr, podID), nil
 }
 
+// isSensitiveHostPath returns true if the given host path is one of the
+// sensitiveHostPaths, is contained in one of them, or contains one of them.
+// Paths are compared by whole components, so that /var/runner is neither
+// contained in /var/run nor contains /var/run/docker.sock.
+func (e *Plugin) isSensitiveHostPath(hostPath string) bool {
+	hostPath = path.Clean(hostPath)
+	for _, p := range sensitiveHostPaths {
+		if hostPath == p || hasPathPrefix(hostPath, p) || hasPathPrefix(p, hostPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPathPrefix returns true if the cleaned path p is contained in the
+// cleaned directory dir
+func hasPathPrefix(p, dir string) bool {
+	if dir == "/" {
+		return false
+	}
+	return strings.HasPrefix(p, dir+"/")
+}
+
+func (e *Plugin) readURIQuery(jsonValue *fastjson.Value) (url.Values, error) {
+	uriValue := jsonValue.Get("requestURI")
+	if uriValue == nil {
+		return nil, ErrExtractNotAvailable
+	}
+	uriString, err := e.jsonValueAsString(uriValue)
+	if err != nil {
+		return nil, err
+	}
+	uri, err := url.Parse(uriString)
+	if err != nil {
+		return nil, err
+	}
+	return url.ParseQuery(uri.RawQuery)
+}
+
+func (e *Plugin) extractURIQueryParam(req sdk.ExtractRequest, jsonValue *fastjson.Value, param string) error {
+	query, err := e.readURIQuery(jsonValue)
+	if err != nil {
+		return err
+	}
+	values := query[param]
+	if len(values) == 0 {
+		return ErrExtractNotAvailable
+	}
+	req.SetValue(values[0])
+	return nil
+}
+
+// extractNetworkPolicyOpen sets the value to true if any of the rules of
+// the network policy of the request object allows traffic from/to any
+// peer. This happens if a rule has no peers, if a peer is an IP block
+// including all addresses, or if a peer selects all pods of all namespaces.
+func (e *Plugin) extractNetworkPolicyOpen(req sdk.ExtractRequest, jsonValue *fastjson.Value, rulesKey, peersKey string) error {
+	if jsonValue.Get("requestObject", "spec") == nil {
+		return ErrExtractNotAvailable
+	}
+	for _, rule := range jsonValue.GetArray("requestObject", "spec", rulesKey) {
+		peers := rule.GetArray(peersKey)
+		if len(peers) == 0 {
+			req.SetValue("true")
+			return nil
+		}
+		for _, peer := range peers {
+			cidr := string(peer.GetStringBytes("ipBlock", "cidr"))
+			if (cidr == "0.0.0.0/0" || cidr == "::/0") && len(peer.GetArray("ipBlock", "except")) == 0 {
+				req.SetValue("true")
+				return nil
+			}
+			nsSelector := peer.GetObject("namespaceSelector")
+			podSelector := peer.GetObject("podSelector")
+			if nsSelector != nil && nsSelector.Len() == 0 && (podSelector == nil || podSelector.Len() == 0) {
+				req.SetValue("true")
+				return nil
+			}
+		}
+	}
+	req.SetValue("false")
+	return nil
+}
+
 func (e *Plugin) extractRulesField(req sdk.ExtractRequest, jsonValue *fastjson.Value, keys ...string) error {
 	arr, err := e.getValuesRecursive(jsonValue, e.argIndexFilter(req), append([]string{"requestObject", "rules"}, keys...)...)
 	if err != nil {
@@ -554,10 +1079,17 @@ func (e *Plugin) extractFromKeys(req sdk.ExtractRequest, jsonValue *fastjson.Val
 		if jsonValue.Type() != fastjson.TypeArray {
 			return ErrExtractWrongType
 		}
+		arr := jsonValue.GetArray()
+		if indexFilter := e.argIndexFilter(req); indexFilter != noIndexFilter {
+			if indexFilter >= len(arr) {
+				return ErrExtractNotAvailable
+			}
+			arr = arr[indexFilter : indexFilter+1]
+		}
 		switch req.FieldType() {
 		case sdk.FieldTypeCharBuf:
 			var res []string
-			for _, v := range jsonValue.GetArray() {
+			for _, v := range arr {
 				val, err := e.jsonValueAsString(v)
 				if err != nil {
 					return err
@@ -576,6 +1108,12 @@ func (e *Plugin) extractFromKeys(req sdk.ExtractRequest, jsonValue *fastjson.Val
 				return err
 			}
 			req.SetValue(val)
+		case sdk.FieldTypeUint64:
+			val, err := jsonValue.Uint64()
+			if err != nil {
+				return ErrExtractWrongType
+			}
+			req.SetValue(val)
 		default:
 			return ErrExtractUnsupportedType
 		}
@@ -583,6 +1121,86 @@ func (e *Plugin) extractFromKeys(req sdk.ExtractRequest, jsonValue *fastjson.Val
 	return nil
 }
 
+// jsonPointerKeys splits a JSON pointer (see RFC 6901) into the sequence
+// of keys it references, e.g. "/spec/containers/0/image" is split in
+// "spec", "containers", "0", and "image". The empty pointer references the
+// whole document, and returns no keys. For convenience, the leading '/'
+// can be omitted.
+func (e *Plugin) jsonPointerKeys(ptr string) []string {
+	ptr = strings.TrimPrefix(ptr, "/")
+	if len(ptr) == 0 {
+		return nil
+	}
+	keys := strings.Split(ptr, "/")
+	for i, k := range keys {
+		keys[i] = strings.ReplaceAll(strings.ReplaceAll(k, "~1", "/"), "~0", "~")
+	}
+	return keys
+}
+
+// extractJQ evaluates a jq expression over the whole audit event, and sets
+// the first value it produces. Compiled expressions are cached, so that each
+// expression is parsed only once, and so is the input of the event last
+// decoded with DecodeReader.
+func (e *Plugin) extractJQ(req sdk.ExtractRequest, jsonValue *fastjson.Value, expr string) error {
+	code, ok := e.jqCache[expr]
+	if !ok {
+		query, err := gojq.Parse(expr)
+		if err != nil {
+			return err
+		}
+		code, err = gojq.Compile(query)
+		if err != nil {
+			return err
+		}
+		if e.jqCache == nil {
+			e.jqCache = make(map[string]*gojq.Code)
+		}
+		e.jqCache[expr] = code
+	}
+
+	// the event is converted to the jq input only once, even if many
+	// expressions are evaluated on it
+	input := e.jqInput
+	if input == nil || jsonValue != e.jdata {
+		input = nil
+		if err := json.Unmarshal(jsonValue.MarshalTo(nil), &input); err != nil {
+			return ErrExtractBrokenJSON
+		}
+		if jsonValue == e.jdata {
+			e.jqInput = input
+		}
+	}
+	res, ok := code.Run(input).Next()
+	if !ok || res == nil {
+		return ErrExtractNotAvailable
+	}
+	switch v := res.(type) {
+	case error:
+		return v
+	case string:
+		req.SetValue(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		req.SetValue(string(b))
+	}
+	return nil
+}
+
+func (e *Plugin) readTimestamp(jsonValue *fastjson.Value, key string) (time.Time, error) {
+	value := jsonValue.Get(key)
+	if value == nil {
+		return time.Time{}, ErrExtractNotAvailable
+	}
+	if value.Type() != fastjson.TypeString {
+		return time.Time{}, ErrExtractWrongType
+	}
+	return time.Parse(time.RFC3339Nano, string(value.GetStringBytes()))
+}
+
 func (e *Plugin) jsonValueAsString(v *fastjson.Value) (string, error) {
 	if v != nil {
 		if v.Type() == fastjson.TypeString {
@@ -20,6 +20,8 @@ import (
 	"bufio"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -36,6 +38,7 @@ type testExtractRequest struct {
 	argPresent bool
 	argIndex   uint64
 	argKey     string
+	value      interface{}
 }
 
 type jsonData struct {
@@ -72,7 +75,7 @@ func (t *testExtractRequest) IsList() bool {
 }
 
 func (t *testExtractRequest) SetValue(v interface{}) {
-
+	t.value = v
 }
 
 func (t *testExtractRequest) SetPtr(unsafe.Pointer) {
@@ -159,3 +162,340 @@ func BenchmarkExtractFromJSON(b *testing.B) {
 	b.ReportMetric(exOp, "extractions/op")
 	b.ReportMetric(nsOp/exOp, "ns/extraction/op")
 }
+
+func TestExtractAllFields(t *testing.T) {
+	req := &testExtractRequest{}
+	e := &Plugin{}
+	json, err := e.DecodeReader(1, strings.NewReader(`{"kind":"Event","auditID":"1","stage":"ResponseComplete"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, field := range e.Fields() {
+		fieldEntryToRequest(uint64(i), &field, req)
+		err := e.ExtractFromJSON(req, json)
+		if err != nil && strings.HasPrefix(err.Error(), "unsupported extraction field") {
+			t.Errorf("extracting field %s: %s", field.Name, err.Error())
+		}
+	}
+}
+
+func TestExtractFromJSONByName(t *testing.T) {
+	e := &Plugin{}
+	json, err := e.DecodeReader(1, strings.NewReader(`{"kind":"Event","auditID":"1","stage":"ResponseComplete","verb":"get"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// plugins embedding the extractor have their own field IDs, which
+	// don't match the ones of this plugin
+	for _, id := range []uint64{0, 1, 1000} {
+		req := &testExtractRequest{fieldID: id, field: "ka.verb", fieldType: sdk.FieldTypeCharBuf}
+		if err := e.ExtractFromJSON(req, json); err != nil {
+			t.Fatal(err)
+		}
+		if req.value != "get" {
+			t.Errorf("field ID %d: expected the value of ka.verb, got %v", id, req.value)
+		}
+	}
+	req := &testExtractRequest{fieldID: 0, field: "ka.unknown", fieldType: sdk.FieldTypeCharBuf}
+	if err := e.ExtractFromJSON(req, json); err == nil {
+		t.Errorf("expected an error for an unknown field")
+	}
+}
+
+func TestIsSensitiveHostPath(t *testing.T) {
+	e := &Plugin{}
+	tests := []struct {
+		path      string
+		sensitive bool
+	}{
+		{"/", true},
+		{"/etc", true},
+		{"/etc/", true},
+		{"/etc/ssl/certs", true},
+		{"/var/run/docker.sock", true},
+		{"/var/run", true},
+		{"/var/run/", true},
+		{"/var", true},
+		{"/var/lib/kubelet/pods", true},
+		{"/var/log/pods", true},
+		{"/sys/fs/cgroup", true},
+		{"/dev", true},
+		{"/var/lib/docker", true},
+		{"/var/runner", false},
+		{"/var/lib/data", false},
+		{"/data", false},
+		{"/etcd", false},
+	}
+	for _, test := range tests {
+		if res := e.isSensitiveHostPath(test.path); res != test.sensitive {
+			t.Errorf("isSensitiveHostPath(%q) = %v, expected %v", test.path, res, test.sensitive)
+		}
+	}
+}
+
+func TestExtractJQ(t *testing.T) {
+	e := &Plugin{}
+	req := &testExtractRequest{}
+	var jqID uint64
+	for i, field := range e.Fields() {
+		if field.Name == "ka.jq" {
+			jqID = uint64(i)
+			fieldEntryToRequest(jqID, &field, req)
+		}
+	}
+	extract := func(evtNum uint64, data, expr string) interface{} {
+		value, err := e.DecodeReader(evtNum, strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.argKey, req.value = expr, nil
+		if err := e.ExtractFromJSON(req, value); err != nil {
+			t.Fatal(err)
+		}
+		return req.value
+	}
+
+	// many expressions are evaluated on the same event, and the input is
+	// refreshed when the next event is decoded
+	event1 := `{"auditID":"1","verb":"get","objectRef":{"resource":"pods"}}`
+	event2 := `{"auditID":"2","verb":"list","objectRef":{"resource":"secrets"}}`
+	if v := extract(1, event1, ".verb"); v != "get" {
+		t.Errorf("unexpected value: %v", v)
+	}
+	if v := extract(1, event1, ".objectRef"); v != `{"resource":"pods"}` {
+		t.Errorf("unexpected value: %v", v)
+	}
+	if v := extract(2, event2, ".objectRef.resource"); v != "secrets" {
+		t.Errorf("unexpected value: %v", v)
+	}
+}
+
+// extractTestField extracts a field from an audit event. The argument, if
+// not empty, is used as the key or index argument of the field.
+func extractTestField(t *testing.T, e *Plugin, evtNum uint64, event, field, arg string) (interface{}, error) {
+	for i, entry := range e.Fields() {
+		if entry.Name != field {
+			continue
+		}
+		req := &testExtractRequest{fieldID: uint64(i), field: entry.Name, isList: entry.IsList}
+		req.fieldType = sdk.FieldTypeUint64
+		if entry.Type == "string" {
+			req.fieldType = sdk.FieldTypeCharBuf
+		}
+		if len(arg) > 0 {
+			req.argPresent = true
+			if entry.Arg.IsIndex {
+				index, err := strconv.ParseUint(arg, 10, 64)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.argIndex = index
+			} else {
+				req.argKey = arg
+			}
+		}
+		value, err := e.DecodeReader(evtNum, strings.NewReader(event))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = e.ExtractFromJSON(req, value)
+		return req.value, err
+	}
+	t.Fatalf("unknown field %s", field)
+	return nil, nil
+}
+
+func TestExtractFieldValues(t *testing.T) {
+	podEvent := `{
+		"kind": "Event", "auditID": "1", "stage": "ResponseComplete", "verb": "create",
+		"requestURI": "/api/v1/namespaces/default/pods",
+		"requestReceivedTimestamp": "2022-01-01T00:00:00.000000Z",
+		"stageTimestamp": "2022-01-01T00:00:00.250000Z",
+		"user": {"username": "admin"},
+		"impersonatedUser": {"username": "alice", "groups": ["dev", "ops"]},
+		"sourceIPs": ["10.0.0.1", "10.0.0.2"],
+		"objectRef": {"resource": "pods", "namespace": "default", "name": "web", "apiGroup": "apps", "apiVersion": "v1", "uid": "1234"},
+		"annotations": {
+			"authorization.k8s.io/decision": "allow",
+			"authorization.k8s.io/reason": "RBAC: allowed",
+			"pod-security.kubernetes.io/enforce-policy": "restricted:latest",
+			"pod-security.kubernetes.io/audit-violations": "privileged",
+			"pod-security.kubernetes.io/exempt": "namespace",
+			"k8s.io/deprecated": "true",
+			"k8s.io/removed-release": "1.25",
+			"k8saudit.falcosecurity.org/owner-kind": "Deployment",
+			"k8saudit.falcosecurity.org/owner-name": "web-deploy",
+			"k8saudit.falcosecurity.org/node-name": "node-1",
+			"k8saudit.falcosecurity.org/node-zone": "zone-a",
+			"k8saudit.falcosecurity.org/node-region": "region-1"
+		},
+		"requestObject": {
+			"metadata": {"labels": {"app": "web"}, "annotations": {"team": "core"}},
+			"spec": {
+				"nodeName": "node-2",
+				"securityContext": {"runAsNonRoot": true},
+				"initContainers": [{"image": "busybox"}],
+				"containers": [
+					{"image": "nginx:1.21", "securityContext": {"runAsNonRoot": false, "capabilities": {"drop": ["ALL"]}}},
+					{"image": "quay.io/org/app@sha256:abcd"}
+				],
+				"volumes": [{"hostPath": {"path": "/data"}}, {"hostPath": {"path": "/var/run"}}]
+			}
+		},
+		"responseObject": {"metadata": {"name": "web"}},
+		"responseStatus": {"code": 403, "reason": "Forbidden", "message": "denied"}
+	}`
+	bindingEvent := `{
+		"kind": "Event", "auditID": "2", "verb": "bind",
+		"objectRef": {"resource": "pods", "subresource": "binding", "name": "web"},
+		"requestObject": {
+			"target": {"name": "node-3"},
+			"roleRef": {"kind": "ClusterRole", "name": "admin"},
+			"subjects": [{"kind": "User", "name": "alice"}, {"kind": "ServiceAccount", "name": "robot"}]
+		}
+	}`
+	tokenEvent := `{
+		"kind": "Event", "auditID": "3", "verb": "create",
+		"objectRef": {"resource": "serviceaccounts", "subresource": "token"},
+		"requestObject": {"spec": {"audiences": ["api", "vault"], "expirationSeconds": 3600}}
+	}`
+	csrEvent := `{
+		"kind": "Event", "auditID": "4", "verb": "update",
+		"objectRef": {"resource": "certificatesigningrequests"},
+		"requestObject": {
+			"spec": {"signerName": "kubernetes.io/kube-apiserver-client", "usages": ["client auth"]},
+			"status": {"conditions": [{"type": "Approved"}]}
+		}
+	}`
+	secretEvent := `{
+		"kind": "Event", "auditID": "5", "verb": "get",
+		"objectRef": {"resource": "secrets"},
+		"annotations": {"k8saudit.falcosecurity.org/secret-referenced": "true"},
+		"responseObject": {"type": "kubernetes.io/tls"}
+	}`
+	execEvent := `{
+		"kind": "Event", "auditID": "6", "verb": "get",
+		"requestURI": "/api/v1/namespaces/default/pods/web/exec?command=sh&command=-c&container=app&stdin=true&tty=false"
+	}`
+	netpolEvent := `{
+		"kind": "Event", "auditID": "7", "verb": "patch",
+		"requestObject": {"spec": {
+			"ingress": [{"from": [{"podSelector": {"matchLabels": {"app": "web"}}}]}, {}],
+			"egress": [{"to": [{"ipBlock": {"cidr": "10.0.0.0/8"}}]}]
+		}}
+	}`
+
+	tests := []struct {
+		event string
+		field string
+		arg   string
+		value interface{}
+	}{
+		{podEvent, "ka.sourceips", "", []string{"10.0.0.1", "10.0.0.2"}},
+		{podEvent, "ka.sourceips", "1", []string{"10.0.0.2"}},
+		{podEvent, "ka.impgroups", "", []string{"dev", "ops"}},
+		{podEvent, "ka.response.code_num", "", uint64(403)},
+		{podEvent, "ka.response.reason", "", "Forbidden"},
+		{podEvent, "ka.response.message", "", "denied"},
+		{podEvent, "ka.req.obj", "/spec/containers/0/image", "nginx:1.21"},
+		{podEvent, "ka.req.obj", "/metadata/labels", `{"app":"web"}`},
+		{podEvent, "ka.resp.obj", "/metadata/name", "web"},
+		{podEvent, "ka.annotations", "k8s.io/removed-release", "1.25"},
+		{podEvent, "ka.auth.decision", "", "allow"},
+		{podEvent, "ka.auth.reason", "", "RBAC: allowed"},
+		{podEvent, "ka.psa.enforce_policy", "", "restricted:latest"},
+		{podEvent, "ka.psa.audit_violations", "", "privileged"},
+		{podEvent, "ka.psa.exempt", "", "namespace"},
+		{podEvent, "ka.req.pod.init_containers.image", "", []string{"busybox"}},
+		{podEvent, "ka.req.pod.run_as_non_root", "", "true"},
+		{podEvent, "ka.req.pod.containers.run_as_non_root", "", []string{"false"}},
+		{podEvent, "ka.req.pod.containers.drop_capabilities", "", []string{"ALL"}},
+		{podEvent, "ka.req.pod.volumes.sensitive_hostpath", "", "true"},
+		{podEvent, "ka.req.pod.node_name", "", "node-2"},
+		{podEvent, "ka.req.pod.containers.image.registry", "", []string{"docker.io", "quay.io"}},
+		{podEvent, "ka.req.pod.containers.image.tag", "", []string{"1.21", ""}},
+		{podEvent, "ka.req.pod.containers.image.digest", "", []string{"", "sha256:abcd"}},
+		{podEvent, "ka.req.pod.containers.image.tag", "0", []string{"1.21"}},
+		{podEvent, "ka.req.obj.labels", "app", "web"},
+		{podEvent, "ka.req.obj.annotations", "team", "core"},
+		{podEvent, "ka.jq", ".requestObject.spec.containers | length", "2"},
+		{podEvent, "ka.latency", "", uint64(250)},
+		{podEvent, "ka.target.apigroup", "", "apps"},
+		{podEvent, "ka.target.apiversion", "", "v1"},
+		{podEvent, "ka.target.uid", "", "1234"},
+		{podEvent, "ka.target.owner.kind", "", "Deployment"},
+		{podEvent, "ka.target.owner.name", "", "web-deploy"},
+		{podEvent, "ka.target.node.name", "", "node-1"},
+		{podEvent, "ka.target.node.zone", "", "zone-a"},
+		{podEvent, "ka.target.node.region", "", "region-1"},
+		{podEvent, "ka.api.deprecated", "", "true"},
+		{podEvent, "ka.api.removed_release", "", "1.25"},
+		{podEvent, "ka.verb.category", "", "write"},
+		{bindingEvent, "ka.verb.category", "", "escalate"},
+		{bindingEvent, "ka.req.pod.node_name", "", "node-3"},
+		{bindingEvent, "ka.req.binding.role.kind", "", "ClusterRole"},
+		{bindingEvent, "ka.req.binding.subject.names", "", []string{"alice", "robot"}},
+		{bindingEvent, "ka.req.binding.subject.kinds", "", []string{"User", "ServiceAccount"}},
+		{bindingEvent, "ka.req.binding.subject.kinds", "1", []string{"ServiceAccount"}},
+		{tokenEvent, "ka.req.token.audiences", "", []string{"api", "vault"}},
+		{tokenEvent, "ka.req.token.expiration_seconds", "", uint64(3600)},
+		{csrEvent, "ka.req.csr.signer_name", "", "kubernetes.io/kube-apiserver-client"},
+		{csrEvent, "ka.req.csr.usages", "", []string{"client auth"}},
+		{csrEvent, "ka.req.csr.conditions", "", []string{"Approved"}},
+		{secretEvent, "ka.secret.type", "", "kubernetes.io/tls"},
+		{secretEvent, "ka.secret.referenced", "", "true"},
+		{execEvent, "ka.req.exec.command", "", "sh -c"},
+		{execEvent, "ka.req.exec.container", "", "app"},
+		{execEvent, "ka.req.exec.stdin", "", "true"},
+		{execEvent, "ka.req.exec.tty", "", "false"},
+		{execEvent, "ka.verb.category", "", "read"},
+		{netpolEvent, "ka.req.networkpolicy.ingress_open", "", "true"},
+		{netpolEvent, "ka.req.networkpolicy.egress_open", "", "false"},
+	}
+	e := &Plugin{}
+	for i, test := range tests {
+		name := test.field
+		if len(test.arg) > 0 {
+			name += "[" + test.arg + "]"
+		}
+		t.Run(name, func(t *testing.T) {
+			value, err := extractTestField(t, e, uint64(i), test.event, test.field, test.arg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(value, test.value) {
+				t.Errorf("expected %#v, got %#v", test.value, value)
+			}
+		})
+	}
+}
+
+func TestExtractImageRepositoryWithPort(t *testing.T) {
+	event := `{
+		"kind": "Event", "auditID": "1", "verb": "create",
+		"requestObject": {"spec": {"containers": [{"image": "localhost:5000/foo:1.0"}]}}
+	}`
+
+	// the repository is extracted by splitting the image on the first
+	// colon since the field was introduced, and existing rules rely on it.
+	// The registry, tag, and digest are parsed as container runtimes do
+	tests := []struct {
+		field string
+		value []string
+	}{
+		{"ka.req.pod.containers.image.repository", []string{"localhost"}},
+		{"ka.req.pod.containers.image.registry", []string{"localhost:5000"}},
+		{"ka.req.pod.containers.image.tag", []string{"1.0"}},
+	}
+	e := &Plugin{}
+	for i, test := range tests {
+		value, err := extractTestField(t, e, uint64(i), event, test.field, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(value, test.value) {
+			t.Errorf("%s: expected %#v, got %#v", test.field, test.value, value)
+		}
+	}
+}
@@ -31,17 +31,74 @@ func (k *Plugin) Fields() []sdk.FieldEntry {
 		{
 			Type: "string",
 			Name: "ka.stage",
-			Desc: "Stage of the request (e.g. RequestReceived, ResponseComplete, etc.)",
+			Desc: "Stage of the request (one of RequestReceived, ResponseStarted, ResponseComplete, Panic)",
+		},
+		{
+			Type: "string",
+			Name: "ka.annotations",
+			Desc: "The value of a given annotation of the audit event (e.g. ka.annotations[authorization.k8s.io/decision])",
+			Arg: sdk.FieldEntryArg{
+				IsRequired: true,
+				IsKey:      true,
+			},
+		},
+		{
+			Type: "string",
+			Name: "ka.jq",
+			Desc: "The first value produced by evaluating a jq expression over the whole audit event (e.g. ka.jq[.requestObject.spec.containers | length]). Objects and arrays are returned as JSON",
+			Arg: sdk.FieldEntryArg{
+				IsRequired: true,
+				IsKey:      true,
+			},
+		},
+		{
+			Type: "string",
+			Name: "ka.cluster.name",
+			Desc: "The name of the cluster the event is coming from, as set in the clusterName init config",
+		},
+		{
+			Type: "string",
+			Name: "ka.label",
+			Desc: "The value of a static label set in the labels init config (e.g. ka.label[environment])",
+			Arg: sdk.FieldEntryArg{
+				IsRequired: true,
+				IsKey:      true,
+			},
 		},
 		{
 			Type: "string",
 			Name: "ka.auth.decision",
-			Desc: "The authorization decision",
+			Desc: "The authorization decision (allow or forbid), from the authorization.k8s.io/decision annotation",
 		},
 		{
 			Type: "string",
 			Name: "ka.auth.reason",
-			Desc: "The authorization reason",
+			Desc: "The authorization reason (e.g. the RBAC binding that allowed the request), from the authorization.k8s.io/reason annotation",
+		},
+		{
+			Type: "string",
+			Name: "ka.psa.enforce_policy",
+			Desc: "The Pod Security admission policy level and version enforced on the request (e.g. restricted:latest)",
+		},
+		{
+			Type: "string",
+			Name: "ka.psa.audit_violations",
+			Desc: "The violations of the Pod Security admission audit policy level detected on the request",
+		},
+		{
+			Type: "string",
+			Name: "ka.psa.exempt",
+			Desc: "The dimension (namespace, user, or runtimeClass) for which the request has been exempted from Pod Security admission",
+		},
+		{
+			Type: "string",
+			Name: "ka.api.deprecated",
+			Desc: "Return true if the request uses a deprecated API version, from the k8s.io/deprecated annotation",
+		},
+		{
+			Type: "string",
+			Name: "ka.api.removed_release",
+			Desc: "When the request uses a deprecated API version, the release in which it is removed (e.g. 1.25), from the k8s.io/removed-release annotation",
 		},
 		{
 			Type: "string",
@@ -53,17 +110,46 @@ func (k *Plugin) Fields() []sdk.FieldEntry {
 			Name:   "ka.user.groups",
 			Desc:   "The groups to which the user belongs",
 			IsList: true,
+			Arg: sdk.FieldEntryArg{
+				IsRequired: false,
+				IsIndex:    true,
+			},
 		},
 		{
 			Type: "string",
 			Name: "ka.impuser.name",
 			Desc: "The impersonated user name",
 		},
+		{
+			Type:   "string",
+			Name:   "ka.impgroups",
+			Desc:   "The groups to which the impersonated user belongs",
+			IsList: true,
+			Arg: sdk.FieldEntryArg{
+				IsRequired: false,
+				IsIndex:    true,
+			},
+		},
+		{
+			Type:   "string",
+			Name:   "ka.sourceips",
+			Desc:   "The IP addresses from which the request originated, including the intermediate proxies",
+			IsList: true,
+			Arg: sdk.FieldEntryArg{
+				IsRequired: false,
+				IsIndex:    true,
+			},
+		},
 		{
 			Type: "string",
 			Name: "ka.verb",
 			Desc: "The action being performed",
 		},
+		{
+			Type: "string",
+			Name: "ka.verb.category",
+			Desc: "The category of the action being performed (one of read, write, delete, impersonate, escalate, other)",
+		},
 		{
 			Type: "string",
 			Name: "ka.uri",
@@ -78,6 +164,26 @@ func (k *Plugin) Fields() []sdk.FieldEntry {
 				IsKey:      true,
 			},
 		},
+		{
+			Type: "string",
+			Name: "ka.req.exec.command",
+			Desc: "When the request refers to a pods/exec subresource, the command being executed with its arguments",
+		},
+		{
+			Type: "string",
+			Name: "ka.req.exec.container",
+			Desc: "When the request refers to a pods/exec or pods/attach subresource, the name of the target container",
+		},
+		{
+			Type: "string",
+			Name: "ka.req.exec.tty",
+			Desc: "When the request refers to a pods/exec or pods/attach subresource, the value of the tty flag",
+		},
+		{
+			Type: "string",
+			Name: "ka.req.exec.stdin",
+			Desc: "When the request refers to a pods/exec or pods/attach subresource, the value of the stdin flag",
+		},
 		{
 			Type: "string",
 			Name: "ka.target.name",
@@ -98,17 +204,113 @@ func (k *Plugin) Fields() []sdk.FieldEntry {
 			Name: "ka.target.subresource",
 			Desc: "The target object subresource",
 		},
+		{
+			Type: "string",
+			Name: "ka.target.apigroup",
+			Desc: "The target object API group (empty for the core API group)",
+		},
+		{
+			Type: "string",
+			Name: "ka.target.apiversion",
+			Desc: "The target object API version",
+		},
+		{
+			Type: "string",
+			Name: "ka.target.uid",
+			Desc: "The target object UID",
+		},
+		{
+			Type: "string",
+			Name: "ka.target.owner.kind",
+			Desc: "When the target object is a pod, the kind of the workload owning it (e.g. Deployment). Requires the enrichOwners init config",
+		},
+		{
+			Type: "string",
+			Name: "ka.target.owner.name",
+			Desc: "When the target object is a pod, the name of the workload owning it. Requires the enrichOwners init config",
+		},
+		{
+			Type: "string",
+			Name: "ka.target.node.name",
+			Desc: "When the target object is a pod, the name of the node on which it is scheduled. Requires the enrichNodes init config",
+		},
+		{
+			Type: "string",
+			Name: "ka.target.node.zone",
+			Desc: "When the target object is a pod, the zone of the node on which it is scheduled. Requires the enrichNodes init config",
+		},
+		{
+			Type: "string",
+			Name: "ka.target.node.region",
+			Desc: "When the target object is a pod, the region of the node on which it is scheduled. Requires the enrichNodes init config",
+		},
+		{
+			Type: "string",
+			Name: "ka.req.obj",
+			Desc: "The value at the given JSON pointer in the request object (e.g. ka.req.obj[/spec/replicas]). Objects and arrays are returned as JSON",
+			Arg: sdk.FieldEntryArg{
+				IsRequired: true,
+				IsKey:      true,
+			},
+		},
+		{
+			Type: "string",
+			Name: "ka.req.obj.labels",
+			Desc: "The value of a given label of the request object (e.g. ka.req.obj.labels[app])",
+			Arg: sdk.FieldEntryArg{
+				IsRequired: true,
+				IsKey:      true,
+			},
+		},
+		{
+			Type: "string",
+			Name: "ka.req.obj.annotations",
+			Desc: "The value of a given annotation of the request object (e.g. ka.req.obj.annotations[security.scan])",
+			Arg: sdk.FieldEntryArg{
+				IsRequired: true,
+				IsKey:      true,
+			},
+		},
 		{
 			Type:   "string",
 			Name:   "ka.req.binding.subjects",
 			Desc:   "When the request object refers to a cluster role binding, the subject (e.g. account/users) being linked by the binding",
 			IsList: true,
+			Arg: sdk.FieldEntryArg{
+				IsRequired: false,
+				IsIndex:    true,
+			},
 		},
 		{
 			Type: "string",
 			Name: "ka.req.binding.role",
 			Desc: "When the request object refers to a cluster role binding, the role being linked by the binding",
 		},
+		{
+			Type: "string",
+			Name: "ka.req.binding.role.kind",
+			Desc: "When the request object refers to a role binding/cluster role binding, the kind of the role being linked by the binding (Role or ClusterRole)",
+		},
+		{
+			Type:   "string",
+			Name:   "ka.req.binding.subject.names",
+			Desc:   "When the request object refers to a role binding/cluster role binding, the names of the subjects being linked by the binding",
+			IsList: true,
+			Arg: sdk.FieldEntryArg{
+				IsRequired: false,
+				IsIndex:    true,
+			},
+		},
+		{
+			Type:   "string",
+			Name:   "ka.req.binding.subject.kinds",
+			Desc:   "When the request object refers to a role binding/cluster role binding, the kinds of the subjects being linked by the binding (e.g. User, Group, ServiceAccount)",
+			IsList: true,
+			Arg: sdk.FieldEntryArg{
+				IsRequired: false,
+				IsIndex:    true,
+			},
+		},
 		{
 			Type: "string",
 			Name: "ka.req.binding.subject.has_name",
@@ -118,6 +320,56 @@ func (k *Plugin) Fields() []sdk.FieldEntry {
 				IsKey:      true,
 			},
 		},
+		{
+			Type:   "string",
+			Name:   "ka.req.token.audiences",
+			Desc:   "When the request object refers to a service account token request, the intended audiences of the token",
+			IsList: true,
+			Arg: sdk.FieldEntryArg{
+				IsRequired: false,
+				IsIndex:    true,
+			},
+		},
+		{
+			Type: "uint64",
+			Name: "ka.req.token.expiration_seconds",
+			Desc: "When the request object refers to a service account token request, the requested duration of validity of the token in seconds",
+		},
+		{
+			Type: "string",
+			Name: "ka.req.csr.signer_name",
+			Desc: "When the request object refers to a certificate signing request, the name of the requested signer",
+		},
+		{
+			Type:   "string",
+			Name:   "ka.req.csr.usages",
+			Desc:   "When the request object refers to a certificate signing request, the requested key usages of the certificate",
+			IsList: true,
+			Arg: sdk.FieldEntryArg{
+				IsRequired: false,
+				IsIndex:    true,
+			},
+		},
+		{
+			Type:   "string",
+			Name:   "ka.req.csr.conditions",
+			Desc:   "When the request object refers to a certificate signing request, the types of its status conditions (e.g. Approved, Denied)",
+			IsList: true,
+			Arg: sdk.FieldEntryArg{
+				IsRequired: false,
+				IsIndex:    true,
+			},
+		},
+		{
+			Type: "string",
+			Name: "ka.secret.type",
+			Desc: "When the target object is a secret, the type of the secret (e.g. Opaque, kubernetes.io/service-account-token). Only available when the request or response object is present",
+		},
+		{
+			Type: "string",
+			Name: "ka.secret.referenced",
+			Desc: "When the target object is a secret and the request is performed by a pod, return true if the secret is referenced by the pod spec. Requires the enrichSecretAccess init config. Empty if the pod is not cached yet, which is typical of the first requests of a pod",
+		},
 		{
 			Type: "string",
 			Name: "ka.req.configmap.name",
@@ -138,6 +390,16 @@ func (k *Plugin) Fields() []sdk.FieldEntry {
 				IsIndex:    true,
 			},
 		},
+		{
+			Type:   "string",
+			Name:   "ka.req.pod.init_containers.image",
+			Desc:   "When the request object refers to a pod, the init container's images.",
+			IsList: true,
+			Arg: sdk.FieldEntryArg{
+				IsRequired: false,
+				IsIndex:    true,
+			},
+		},
 		{
 			Type: "string",
 			Name: "ka.req.container.image",
@@ -153,11 +415,46 @@ func (k *Plugin) Fields() []sdk.FieldEntry {
 				IsIndex:    true,
 			},
 		},
+		{
+			Type:   "string",
+			Name:   "ka.req.pod.containers.image.registry",
+			Desc:   "When the request object refers to a pod, the registry of the container's images (e.g. docker.io).",
+			IsList: true,
+			Arg: sdk.FieldEntryArg{
+				IsRequired: false,
+				IsIndex:    true,
+			},
+		},
+		{
+			Type:   "string",
+			Name:   "ka.req.pod.containers.image.tag",
+			Desc:   "When the request object refers to a pod, the tag of the container's images (e.g. latest). Empty if the image is referenced by digest only.",
+			IsList: true,
+			Arg: sdk.FieldEntryArg{
+				IsRequired: false,
+				IsIndex:    true,
+			},
+		},
+		{
+			Type:   "string",
+			Name:   "ka.req.pod.containers.image.digest",
+			Desc:   "When the request object refers to a pod, the digest of the container's images (e.g. sha256:...). Empty if the image is not referenced by digest.",
+			IsList: true,
+			Arg: sdk.FieldEntryArg{
+				IsRequired: false,
+				IsIndex:    true,
+			},
+		},
 		{
 			Type: "string",
 			Name: "ka.req.container.image.repository",
 			Desc: "Deprecated by ka.req.pod.containers.image.repository. Returns the repository of the first container only",
 		},
+		{
+			Type: "string",
+			Name: "ka.req.pod.node_name",
+			Desc: "When the request object refers to a pod or a pod binding, the name of the node on which the pod is scheduled.",
+		},
 		{
 			Type: "string",
 			Name: "ka.req.pod.host_ipc",
@@ -248,6 +545,21 @@ func (k *Plugin) Fields() []sdk.FieldEntry {
 				IsIndex:    true,
 			},
 		},
+		{
+			Type: "string",
+			Name: "ka.req.pod.run_as_non_root",
+			Desc: "When the request object refers to a pod, the runAsNonRoot flag specified in the security context for the pod",
+		},
+		{
+			Type:   "string",
+			Name:   "ka.req.pod.containers.run_as_non_root",
+			Desc:   "When the request object refers to a pod, the runAsNonRoot flag for all containers",
+			IsList: true,
+			Arg: sdk.FieldEntryArg{
+				IsRequired: false,
+				IsIndex:    true,
+			},
+		},
 		{
 			Type: "string",
 			Name: "ka.req.pod.run_as_group",
@@ -288,6 +600,10 @@ func (k *Plugin) Fields() []sdk.FieldEntry {
 			Name:   "ka.req.role.rules",
 			Desc:   "When the request object refers to a role/cluster role, the rules associated with the role",
 			IsList: true,
+			Arg: sdk.FieldEntryArg{
+				IsRequired: false,
+				IsIndex:    true,
+			},
 		},
 		{
 			Type:   "string",
@@ -339,6 +655,10 @@ func (k *Plugin) Fields() []sdk.FieldEntry {
 			Name:   "ka.req.pod.supplemental_groups",
 			Desc:   "When the request object refers to a pod, the supplementalGroup gids specified by the security context.",
 			IsList: true,
+			Arg: sdk.FieldEntryArg{
+				IsRequired: false,
+				IsIndex:    true,
+			},
 		},
 		{
 			Type:   "string",
@@ -350,6 +670,16 @@ func (k *Plugin) Fields() []sdk.FieldEntry {
 				IsIndex:    true,
 			},
 		},
+		{
+			Type:   "string",
+			Name:   "ka.req.pod.containers.drop_capabilities",
+			Desc:   "When the request object refers to a pod, all capabilities to drop when running the containers, flattened in a single list (e.g. ALL).",
+			IsList: true,
+			Arg: sdk.FieldEntryArg{
+				IsRequired: false,
+				IsIndex:    true,
+			},
+		},
 		{
 			Type: "string",
 			Name: "ka.req.service.type",
@@ -365,6 +695,16 @@ func (k *Plugin) Fields() []sdk.FieldEntry {
 				IsIndex:    true,
 			},
 		},
+		{
+			Type: "string",
+			Name: "ka.req.networkpolicy.ingress_open",
+			Desc: "When the request object refers to a network policy, return true if any ingress rule allows traffic from any source (e.g. empty rule, 0.0.0.0/0, or all namespaces)",
+		},
+		{
+			Type: "string",
+			Name: "ka.req.networkpolicy.egress_open",
+			Desc: "When the request object refers to a network policy, return true if any egress rule allows traffic to any destination (e.g. empty rule, 0.0.0.0/0, or all namespaces)",
+		},
 		{
 			Type:   "string",
 			Name:   "ka.req.pod.volumes.hostpath",
@@ -384,6 +724,11 @@ func (k *Plugin) Fields() []sdk.FieldEntry {
 				IsKey:      true,
 			},
 		},
+		{
+			Type: "string",
+			Name: "ka.req.pod.volumes.sensitive_hostpath",
+			Desc: "When the request object refers to a pod, return true if any volume mounts a sensitive host path (e.g. /etc, /proc, /var/run/docker.sock, /var/lib/kubelet), or a directory containing one (e.g. /var/run)",
+		},
 		{
 			Type:   "string",
 			Name:   "ka.req.pod.volumes.flexvolume_driver",
@@ -409,20 +754,64 @@ func (k *Plugin) Fields() []sdk.FieldEntry {
 			Name: "ka.resp.name",
 			Desc: "The response object name",
 		},
+		{
+			Type: "string",
+			Name: "ka.resp.obj",
+			Desc: "The value at the given JSON pointer in the response object (e.g. ka.resp.obj[/metadata/name]). Objects and arrays are returned as JSON",
+			Arg: sdk.FieldEntryArg{
+				IsRequired: true,
+				IsKey:      true,
+			},
+		},
 		{
 			Type: "string",
 			Name: "ka.response.code",
 			Desc: "The response code",
 		},
+		{
+			Type: "uint64",
+			Name: "ka.response.code_num",
+			Desc: "The response code as a number, usable with comparison operators (e.g. ka.response.code_num >= 400)",
+		},
 		{
 			Type: "string",
 			Name: "ka.response.reason",
 			Desc: "The response reason (usually present only for failures)",
 		},
+		{
+			Type: "string",
+			Name: "ka.response.message",
+			Desc: "The response message (usually present only for failures, e.g. admission webhook denials)",
+		},
+		{
+			Type: "uint64",
+			Name: "ka.latency",
+			Desc: "The time elapsed between the reception of the request and the current stage of the event, in milliseconds",
+		},
 		{
 			Type: "string",
 			Name: "ka.useragent",
 			Desc: "The useragent of the client who made the request to the apiserver",
 		},
+		{
+			Type: "string",
+			Name: "ka.heartbeat",
+			Desc: "'true' if the event is a synthetic heartbeat injected by the plugin, 'false' otherwise",
+		},
+		{
+			Type: "uint64",
+			Name: "ka.plugin.events_received",
+			Desc: "The number of audit events received by the plugin so far across all its event sources, at the time of the extraction",
+		},
+		{
+			Type: "uint64",
+			Name: "ka.plugin.events_dropped",
+			Desc: "The number of messages or audit events dropped by the plugin so far across all its event sources (e.g. oversize or parse errors or overflows), at the time of the extraction",
+		},
+		{
+			Type: "uint64",
+			Name: "ka.plugin.queue_depth",
+			Desc: "The number of messages and audit events queued in the opened event sources waiting to be emitted, at the time of the extraction",
+		},
 	}
 }
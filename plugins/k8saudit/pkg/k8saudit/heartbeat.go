@@ -0,0 +1,74 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+const (
+	// heartbeatAnnotation is the audit annotation marking the synthetic
+	// heartbeat events injected by the plugin
+	heartbeatAnnotation = enrichAnnotationPrefix + "heartbeat"
+	//
+	// heartbeatSourceAnnotation is the audit annotation containing the
+	// event source that injected a heartbeat event
+	heartbeatSourceAnnotation = enrichAnnotationPrefix + "heartbeat-source"
+	//
+	// heartbeatUser is the username of the heartbeat events. The system:
+	// prefix keeps them out of the rules matching non-system users
+	heartbeatUser = "system:k8saudit:heartbeat"
+)
+
+// newHeartbeatEvent returns a synthetic audit event marked as heartbeat,
+// injected by the given event source
+func (k *Plugin) newHeartbeatEvent(source string, now time.Time) (*auditEvent, error) {
+	id := randomHex(16)
+	timestamp := now.UTC().Format(time.RFC3339Nano)
+	data, err := json.Marshal(map[string]interface{}{
+		"kind":                     "Event",
+		"apiVersion":               "audit.k8s.io/v1",
+		"level":                    "Metadata",
+		"auditID":                  id[0:8] + "-" + id[8:12] + "-" + id[12:16] + "-" + id[16:20] + "-" + id[20:32],
+		"stage":                    "ResponseComplete",
+		"requestURI":               "/" + pluginName + "/heartbeat",
+		"verb":                     "heartbeat",
+		"user":                     map[string]string{"username": heartbeatUser},
+		"requestReceivedTimestamp": timestamp,
+		"stageTimestamp":           timestamp,
+		"annotations": map[string]string{
+			heartbeatAnnotation:       "true",
+			heartbeatSourceAnnotation: source,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	value, err := fastjson.ParseBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	ev, err := k.parseJSONAuditEvent(value)
+	if err != nil {
+		return nil, err
+	}
+	ev.synthetic = true
+	return ev, nil
+}
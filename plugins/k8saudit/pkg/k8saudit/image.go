@@ -0,0 +1,65 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import "strings"
+
+const (
+	defaultImageRegistry = "docker.io"
+	defaultImageTag      = "latest"
+)
+
+// imageRef represents the components of a container image reference
+type imageRef struct {
+	Registry string
+	Tag      string
+	Digest   string
+}
+
+// parseImageRef splits a container image reference in its components,
+// normalizing them the same way container runtimes do. For example,
+// "nginx" is parsed as registry "docker.io" and tag "latest". The tag
+// defaults to "latest" only when no digest is specified. The repository
+// is not part of the result, since ka.req.pod.containers.image.repository
+// predates this function and keeps splitting the image on the first colon.
+func parseImageRef(image string) *imageRef {
+	res := &imageRef{}
+	if i := strings.Index(image, "@"); i >= 0 {
+		res.Digest = image[i+1:]
+		image = image[:i]
+	}
+	// the tag separator must come after the last path component, so that
+	// we don't confuse it with a registry port (e.g. localhost:5000/foo)
+	if i := strings.LastIndex(image, ":"); i >= 0 && !strings.Contains(image[i:], "/") {
+		res.Tag = image[i+1:]
+		image = image[:i]
+	}
+	if len(res.Tag) == 0 && len(res.Digest) == 0 {
+		res.Tag = defaultImageTag
+	}
+
+	// the first path component is a registry only if it looks like a
+	// hostname, otherwise the image is hosted on the default registry
+	res.Registry = defaultImageRegistry
+	if i := strings.Index(image, "/"); i >= 0 {
+		host := image[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			res.Registry = host
+		}
+	}
+	return res
+}
@@ -0,0 +1,37 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import "testing"
+
+func TestParseImageRef(t *testing.T) {
+	tests := []struct {
+		image    string
+		expected imageRef
+	}{
+		{"nginx", imageRef{"docker.io", "latest", ""}},
+		{"falcosecurity/falco:0.32.0", imageRef{"docker.io", "0.32.0", ""}},
+		{"gcr.io/project/app@sha256:abcd", imageRef{"gcr.io", "", "sha256:abcd"}},
+		{"localhost:5000/app:v1@sha256:abcd", imageRef{"localhost:5000", "v1", "sha256:abcd"}},
+		{"localhost/app", imageRef{"localhost", "latest", ""}},
+	}
+	for _, test := range tests {
+		if res := parseImageRef(test.image); *res != test.expected {
+			t.Errorf("parsing %s: expected %+v, got %+v", test.image, test.expected, *res)
+		}
+	}
+}
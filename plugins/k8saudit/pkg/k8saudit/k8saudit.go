@@ -18,13 +18,15 @@ package k8saudit
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
 	"os"
+	"time"
 
 	"github.com/alecthomas/jsonschema"
 	"github.com/falcosecurity/plugin-sdk-go/pkg/sdk"
 	"github.com/falcosecurity/plugin-sdk-go/pkg/sdk/plugins"
 	"github.com/falcosecurity/plugin-sdk-go/pkg/sdk/symbols/extract"
+	"github.com/itchyny/gojq"
 	"github.com/valyala/fastjson"
 )
 
@@ -40,11 +42,22 @@ const pluginName = "k8saudit"
 // of JSON data.
 type Plugin struct {
 	plugins.BasePlugin
-	logger      *log.Logger
+	logger      *pluginLogger
 	Config      PluginConfig
 	jparser     fastjson.Parser
 	jdata       *fastjson.Value
 	jdataEvtnum uint64
+	jdataBuf    []byte
+	kube        *kubeClient
+	jqCache     map[string]*gojq.Code
+	jqInput     interface{}
+	checkpoints *checkpointStore
+	deadLetter  *deadLetterWriter
+	overflow    overflowStats
+	dedup       *dedupStore
+	metrics     pluginMetrics
+	tracer      *tracer
+	stopSummary func()
 }
 
 func (k *Plugin) Info() *plugins.Info {
@@ -59,6 +72,15 @@ func (k *Plugin) Info() *plugins.Info {
 }
 
 func (k *Plugin) Init(cfg string) error {
+	// release the resources acquired so far if the initialization fails
+	err := k.init(cfg)
+	if err != nil {
+		k.Destroy()
+	}
+	return err
+}
+
+func (k *Plugin) init(cfg string) error {
 	// read configuration
 	k.Config.Reset()
 	err := json.Unmarshal([]byte(cfg), &k.Config)
@@ -66,14 +88,120 @@ func (k *Plugin) Init(cfg string) error {
 		return err
 	}
 
+	if err := validateOverflowPolicy(k.Config.OverflowPolicy); err != nil {
+		return err
+	}
+	if k.Config.BatchSize == 0 {
+		return fmt.Errorf("invalid batchSize: must be greater than zero")
+	}
+	if k.Config.BatchTimeoutMs == 0 {
+		return fmt.Errorf("invalid batchTimeoutMs: must be greater than zero")
+	}
+	switch k.Config.FileEOFBehavior {
+	case fileEOFClose, fileEOFFollow, fileEOFIdle:
+	default:
+		return fmt.Errorf("invalid fileEOFBehavior: %s", k.Config.FileEOFBehavior)
+	}
+
 	// setup optional async extraction optimization
 	extract.SetAsync(k.Config.UseAsync)
 
 	// setup internal logger
-	k.logger = log.New(os.Stderr, "["+pluginName+"] ", log.LstdFlags|log.LUTC|log.Lmsgprefix)
+	k.logger, err = newPluginLogger(os.Stderr, k.Config.LogLevel, k.Config.LogFormat)
+	if err != nil {
+		return err
+	}
+	if len(k.Config.ClusterName) > 0 {
+		k.logger = k.logger.With("cluster", k.Config.ClusterName)
+	}
+
+	// setup the checkpoint store of file sources
+	if len(k.Config.FileCheckpointPath) > 0 {
+		k.checkpoints = newCheckpointStore(k.Config.FileCheckpointPath)
+	}
+
+	if k.Config.TracingSampleRatio < 0 || k.Config.TracingSampleRatio > 1 {
+		return fmt.Errorf("invalid tracingSampleRatio: must be between 0 and 1")
+	}
+	if k.Config.EnablePprof && len(k.Config.MetricsAddress) == 0 {
+		return fmt.Errorf("enablePprof requires metricsAddress to be set")
+	}
+
+	// setup the internal metrics
+	var constLabels []metricLabel
+	if len(k.Config.ClusterName) > 0 {
+		constLabels = append(constLabels, metricLabel{"cluster", k.Config.ClusterName})
+	}
+	k.metrics.init(constLabels...)
+
+	// setup the optional tracing of the ingest path
+	if len(k.Config.TracingEndpoint) > 0 {
+		k.tracer = newTracer(k.Config.TracingEndpoint, k.Config.TracingSampleRatio, k.metrics.spansDropped.With(), k.logger)
+	}
+
+	// setup the dedup store of emitted events
+	if len(k.Config.DedupStorePath) > 0 {
+		ttl := time.Duration(k.Config.DedupTTLSecs) * time.Second
+		k.dedup, err = openDedupStore(k.Config.DedupStorePath, ttl)
+		if err != nil {
+			return err
+		}
+	}
+
+	// setup the dead-letter output of unparseable payloads
+	if len(k.Config.DeadLetterPath) > 0 {
+		k.deadLetter = newDeadLetterWriter(k.Config.DeadLetterPath, int64(k.Config.DeadLetterMaxSize))
+	}
+
+	// setup the Kubernetes API client, if any enrichment requires it
+	if k.Config.EnrichOwners || k.Config.EnrichNodes || k.Config.EnrichSecretAccess {
+		k.kube, err = newInClusterKubeClient(func(err error) {
+			k.logger.Warnf("can't retrieve Kubernetes object: %s", err.Error())
+			k.countError(kubeErrorCategory(err))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// optionally, serve the metrics over HTTP and log a periodic summary.
+	// These are started last, so that nothing is left running if any of
+	// the previous steps fails
+	if len(k.Config.MetricsAddress) > 0 {
+		if err := k.metrics.Serve(k.Config.MetricsAddress, k.Config.EnablePprof, k.logger); err != nil {
+			return err
+		}
+	}
+	if k.Config.SummaryIntervalSecs > 0 {
+		k.stopSummary = k.startSummaryLog(time.Duration(k.Config.SummaryIntervalSecs) * time.Second)
+	}
 	return nil
 }
 
+func (k *Plugin) Destroy() {
+	// resources are reset once released, so that Destroy is safe to call
+	// after a failed Init
+	if k.stopSummary != nil {
+		k.stopSummary()
+		k.stopSummary = nil
+	}
+	k.metrics.Shutdown()
+	if k.tracer != nil {
+		k.tracer.Shutdown()
+		k.tracer = nil
+	}
+	if k.kube != nil {
+		k.kube.Close()
+		k.kube = nil
+	}
+	if k.dedup != nil {
+		if err := k.dedup.Close(); err != nil {
+			k.logger.Errorf("can't close dedup store: %s", err.Error())
+		}
+		k.dedup = nil
+	}
+}
+
 func (p *Plugin) InitSchema() *sdk.SchemaInfo {
 	reflector := jsonschema.Reflector{
 		// all properties are optional by default
@@ -0,0 +1,337 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	kubeRequestTimeout    = 5 * time.Second
+	kubeCacheTTL          = 5 * time.Minute
+	kubeMissCacheTTL      = 5 * time.Second
+	kubeCacheMaxSize      = 10000
+	kubeFetchWorkers      = 4
+	kubeFetchQueueSize    = 1000
+)
+
+type kubeOwnerReference struct {
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Controller bool   `json:"controller"`
+}
+
+// kubeObject is the subset of a Kubernetes object definition that is
+// relevant for the plugin enrichments.
+type kubeObject struct {
+	Metadata struct {
+		Name            string               `json:"name"`
+		Labels          map[string]string    `json:"labels"`
+		OwnerReferences []kubeOwnerReference `json:"ownerReferences"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName         string          `json:"nodeName"`
+		Containers       []kubeContainer `json:"containers"`
+		InitContainers   []kubeContainer `json:"initContainers"`
+		ImagePullSecrets []kubeLocalObj  `json:"imagePullSecrets"`
+		Volumes          []kubeVolume    `json:"volumes"`
+	} `json:"spec"`
+}
+
+type kubeLocalObj struct {
+	Name string `json:"name"`
+}
+
+type kubeContainer struct {
+	Env []struct {
+		ValueFrom *struct {
+			SecretKeyRef *kubeLocalObj `json:"secretKeyRef"`
+		} `json:"valueFrom"`
+	} `json:"env"`
+	EnvFrom []struct {
+		SecretRef *kubeLocalObj `json:"secretRef"`
+	} `json:"envFrom"`
+}
+
+type kubeVolume struct {
+	Secret *struct {
+		SecretName string `json:"secretName"`
+	} `json:"secret"`
+	Projected *struct {
+		Sources []struct {
+			Secret *kubeLocalObj `json:"secret"`
+		} `json:"sources"`
+	} `json:"projected"`
+}
+
+// controller returns the owner reference of the object that is marked
+// as its managing controller, or nil if there is none.
+func (o *kubeObject) controller() *kubeOwnerReference {
+	for i, ref := range o.Metadata.OwnerReferences {
+		if ref.Controller {
+			return &o.Metadata.OwnerReferences[i]
+		}
+	}
+	return nil
+}
+
+// referencesSecret returns true if the object is a pod that references
+// the secret with the given name in its volumes, environment variables,
+// or image pull secrets.
+func (o *kubeObject) referencesSecret(name string) bool {
+	for _, s := range o.Spec.ImagePullSecrets {
+		if s.Name == name {
+			return true
+		}
+	}
+	for _, v := range o.Spec.Volumes {
+		if v.Secret != nil && v.Secret.SecretName == name {
+			return true
+		}
+		if v.Projected != nil {
+			for _, src := range v.Projected.Sources {
+				if src.Secret != nil && src.Secret.Name == name {
+					return true
+				}
+			}
+		}
+	}
+	for _, c := range append(o.Spec.Containers, o.Spec.InitContainers...) {
+		for _, env := range c.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil && env.ValueFrom.SecretKeyRef.Name == name {
+				return true
+			}
+		}
+		for _, env := range c.EnvFrom {
+			if env.SecretRef != nil && env.SecretRef.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type kubeCacheEntry struct {
+	path    string
+	object  *kubeObject
+	expires time.Time
+}
+
+// kubeClient is a minimal read-only client for the Kubernetes API server.
+// It authenticates with the service account mounted in the pod in which
+// Falco is running. The objects are retrieved asynchronously by a pool of
+// workers and are cached for kubeCacheTTL, so that querying the client
+// never blocks the ingestion of the events. Objects that don't exist are
+// cached for kubeMissCacheTTL only, since they are often about to be
+// created. The least recently used
+// objects are evicted once the cache is full.
+type kubeClient struct {
+	host      string
+	tokenPath string
+	client    *http.Client
+	maxSize   int
+	onError   func(error)
+	ctx       context.Context
+	cancel    func()
+	queue     chan string
+	mu        sync.Mutex
+	cache     map[string]*list.Element
+	lru       *list.List
+	fetching  map[string]bool
+}
+
+// newInClusterKubeClient creates a kubeClient using the in-cluster
+// configuration of the pod in which Falco is running. OnError is invoked
+// with the errors occurred while retrieving objects.
+func newInClusterKubeClient(onError func(error)) (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if len(host) == 0 || len(port) == 0 {
+		return nil, fmt.Errorf("can't find in-cluster Kubernetes configuration, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be defined")
+	}
+	if _, err := os.Stat(kubeServiceAccountDir + "/token"); err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(kubeServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("can't load Kubernetes CA certificate")
+	}
+	client := &http.Client{
+		Timeout: kubeRequestTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: certPool},
+		},
+	}
+	return newKubeClient("https://"+net.JoinHostPort(host, port), kubeServiceAccountDir+"/token", client, onError), nil
+}
+
+// newKubeClient creates a kubeClient querying the API server at the given
+// URL, authenticating with the token contained in the given file. The
+// token is read again for each request, so that rotated tokens are used as
+// soon as they are available.
+func newKubeClient(host, tokenPath string, client *http.Client, onError func(error)) *kubeClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &kubeClient{
+		host:      host,
+		tokenPath: tokenPath,
+		client:    client,
+		maxSize:   kubeCacheMaxSize,
+		onError:   onError,
+		ctx:       ctx,
+		cancel:    cancel,
+		queue:     make(chan string, kubeFetchQueueSize),
+		cache:     make(map[string]*list.Element),
+		lru:       list.New(),
+		fetching:  make(map[string]bool),
+	}
+	for i := 0; i < kubeFetchWorkers; i++ {
+		go c.fetchLoop()
+	}
+	return c
+}
+
+// Get returns the object at the given API path (e.g. /api/v1/nodes/foo)
+// from the cache, and never blocks on the API server. Objects that are not
+// cached or that are expired are queued for retrieval, and the expired ones
+// are returned until they are refreshed. Returns false if the object is
+// not cached, and nil with true if the object does not exist.
+func (c *kubeClient) Get(path string) (*kubeObject, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.cache[path]
+	if !ok {
+		c.enqueue(path)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	entry := elem.Value.(*kubeCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.enqueue(path)
+	}
+	return entry.object, true
+}
+
+// Close stops the retrieval of the objects
+func (c *kubeClient) Close() {
+	c.cancel()
+}
+
+// enqueue queues an object for retrieval, unless it's already queued. The
+// object is not queued if the queue is full, and will be queued again by
+// a later cache miss. Must be called while holding the lock.
+func (c *kubeClient) enqueue(path string) {
+	if c.fetching[path] {
+		return
+	}
+	select {
+	case c.queue <- path:
+		c.fetching[path] = true
+	default:
+	}
+}
+
+func (c *kubeClient) fetchLoop() {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case path := <-c.queue:
+			obj, err := c.fetch(path)
+			c.mu.Lock()
+			delete(c.fetching, path)
+			if err == nil {
+				c.put(path, obj)
+			}
+			c.mu.Unlock()
+			if err != nil && c.onError != nil && c.ctx.Err() == nil {
+				c.onError(err)
+			}
+		}
+	}
+}
+
+// fetch retrieves an object from the API server. Returns nil with no
+// error if the object does not exist.
+func (c *kubeClient) fetch(path string) (*kubeObject, error) {
+	token, err := ioutil.ReadFile(c.tokenPath)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, kubeRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", c.host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		obj := &kubeObject{}
+		if err := json.NewDecoder(res.Body).Decode(obj); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	case http.StatusNotFound:
+		// cache the miss too, so that we don't query deleted objects repeatedly
+		return nil, nil
+	}
+	return nil, &kubeStatusError{path: path, status: res.Status, code: res.StatusCode}
+}
+
+// put adds an object to the cache, evicting the least recently used ones
+// if the cache is full. Must be called while holding the lock.
+func (c *kubeClient) put(path string, obj *kubeObject) {
+	ttl := kubeCacheTTL
+	if obj == nil {
+		ttl = kubeMissCacheTTL
+	}
+	entry := &kubeCacheEntry{path: path, object: obj, expires: time.Now().Add(ttl)}
+	if elem, ok := c.cache[path]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.cache[path] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxSize {
+		elem := c.lru.Back()
+		c.lru.Remove(elem)
+		delete(c.cache, elem.Value.(*kubeCacheEntry).path)
+	}
+}
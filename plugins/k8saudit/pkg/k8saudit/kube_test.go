@@ -0,0 +1,254 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+// testKubeServer is a fake Kubernetes API server serving the given objects
+// by path, and recording the tokens of the received requests
+type testKubeServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	objects map[string]interface{}
+	tokens  []string
+}
+
+func newTestKubeServer(t *testing.T, objects map[string]interface{}) *testKubeServer {
+	s := &testKubeServer{objects: objects}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.mu.Lock()
+		s.tokens = append(s.tokens, strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+		obj, ok := s.objects[req.URL.EscapedPath()]
+		s.mu.Unlock()
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		json.NewEncoder(w).Encode(obj)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// newTestKubeClient returns a client of the given server, authenticating
+// with the token written in the returned file
+func newTestKubeClient(t *testing.T, s *testKubeServer) (*kubeClient, string) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenPath, []byte("token1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := newKubeClient(s.URL, tokenPath, s.Client(), func(err error) { t.Error(err) })
+	t.Cleanup(c.Close)
+	return c, tokenPath
+}
+
+// waitKubeObject queries the client until the object at the given path is
+// cached, and returns it
+func waitKubeObject(t *testing.T, c *kubeClient, path string) *kubeObject {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if obj, ok := c.Get(path); ok {
+			return obj
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", path)
+	return nil
+}
+
+func TestKubeClientGet(t *testing.T) {
+	s := newTestKubeServer(t, map[string]interface{}{
+		"/api/v1/nodes/node1": map[string]interface{}{"metadata": map[string]interface{}{"name": "node1"}},
+	})
+	c, tokenPath := newTestKubeClient(t, s)
+
+	// the first query is a cache miss, and never blocks
+	if _, ok := c.Get("/api/v1/nodes/node1"); ok {
+		t.Errorf("expected cache miss")
+	}
+	if obj := waitKubeObject(t, c, "/api/v1/nodes/node1"); obj == nil || obj.Metadata.Name != "node1" {
+		t.Errorf("unexpected object: %+v", obj)
+	}
+	if obj := waitKubeObject(t, c, "/api/v1/nodes/node2"); obj != nil {
+		t.Errorf("expected non-existing object, got %+v", obj)
+	}
+
+	// rotated tokens are used by the following requests
+	if err := ioutil.WriteFile(tokenPath, []byte("token2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitKubeObject(t, c, "/api/v1/nodes/node3")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.tokens) != 3 || s.tokens[0] != "token1" || s.tokens[2] != "token2" {
+		t.Errorf("unexpected tokens: %v", s.tokens)
+	}
+}
+
+func TestKubeClientMissTTL(t *testing.T) {
+	c := newKubeClient("", "", nil, nil)
+	defer c.Close()
+	c.mu.Lock()
+	c.put("missing", nil)
+	c.put("existing", &kubeObject{})
+	c.mu.Unlock()
+
+	// objects that don't exist are cached for a shorter time
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path, ttl := range map[string]time.Duration{"missing": kubeMissCacheTTL, "existing": kubeCacheTTL} {
+		remaining := time.Until(c.cache[path].Value.(*kubeCacheEntry).expires)
+		if remaining > ttl || remaining < ttl-time.Second {
+			t.Errorf("expected %s to be cached for %s, got %s", path, ttl, remaining)
+		}
+	}
+}
+
+func TestKubeClientEviction(t *testing.T) {
+	c := newKubeClient("", "", nil, nil)
+	defer c.Close()
+	c.maxSize = 2
+	c.mu.Lock()
+	c.put("a", nil)
+	c.put("b", nil)
+	c.mu.Unlock()
+
+	// the least recently used object is evicted, and live ones are kept
+	c.Get("a")
+	c.mu.Lock()
+	c.put("c", nil)
+	c.mu.Unlock()
+	for path, cached := range map[string]bool{"a": true, "b": false, "c": true} {
+		c.mu.Lock()
+		_, ok := c.cache[path]
+		c.mu.Unlock()
+		if ok != cached {
+			t.Errorf("unexpected cached state of %s: %v", path, ok)
+		}
+	}
+}
+
+func TestResolvePodNode(t *testing.T) {
+	s := newTestKubeServer(t, map[string]interface{}{
+		"/api/v1/nodes/node1": map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"name":   "node1",
+				"labels": map[string]string{nodeZoneLabel: "zone1"},
+			},
+		},
+	})
+	p := &Plugin{}
+	p.Config.Reset()
+	p.kube, _ = newTestKubeClient(t, s)
+
+	tests := []struct {
+		name  string
+		event string
+	}{
+		{
+			name:  "pod",
+			event: `{"objectRef":{"resource":"pods","namespace":"default","name":"pod1"},"responseObject":{"metadata":{"name":"pod1"},"spec":{"nodeName":"node1"}}}`,
+		},
+		{
+			name:  "binding",
+			event: `{"objectRef":{"resource":"pods","subresource":"binding","namespace":"default","name":"pod1"},"requestObject":{"target":{"name":"node1"}}}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value := fastjson.MustParse(test.event)
+			deadline := time.Now().Add(5 * time.Second)
+			var node *kubeObject
+			for node == nil && time.Now().Before(deadline) {
+				var err error
+				if node, err = p.resolvePodNode(value); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if node == nil || node.Metadata.Name != "node1" || node.Metadata.Labels[nodeZoneLabel] != "zone1" {
+				t.Errorf("unexpected node: %+v", node)
+			}
+		})
+	}
+
+	// events referring to objects not cached yet are not enriched
+	value := fastjson.MustParse(`{"objectRef":{"resource":"pods","subresource":"binding"},"requestObject":{"target":{"name":"node2"}}}`)
+	if node, err := p.resolvePodNode(value); err != nil || node != nil {
+		t.Errorf("expected no node on cache miss, got %+v (%v)", node, err)
+	}
+}
+
+func TestResolveSecretReferenced(t *testing.T) {
+	pod := map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "pod1"},
+		"spec": map[string]interface{}{
+			"volumes": []interface{}{
+				map[string]interface{}{"secret": map[string]string{"secretName": "secret1"}},
+			},
+		},
+	}
+	s := newTestKubeServer(t, map[string]interface{}{
+		"/api/v1/namespaces/default/pods/pod1":      pod,
+		"/api/v1/namespaces/default/pods/..%2Fpod1": pod,
+	})
+	p := &Plugin{}
+	p.Config.Reset()
+	p.kube, _ = newTestKubeClient(t, s)
+
+	event := func(secret, pod string) *fastjson.Value {
+		return fastjson.MustParse(fmt.Sprintf(`{"objectRef":{"resource":"secrets","namespace":"default","name":%q},"user":{"username":"system:serviceaccount:default:sa","extra":{%q:[%q]}}}`, secret, podNameUserExtra, pod))
+	}
+	tests := []struct {
+		name     string
+		event    *fastjson.Value
+		expected string
+	}{
+		{"referenced", event("secret1", "pod1"), "true"},
+		{"not referenced", event("secret2", "pod1"), "false"},
+		{"escaped pod name", event("secret1", "../pod1"), "true"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deadline := time.Now().Add(5 * time.Second)
+			var res string
+			for len(res) == 0 && time.Now().Before(deadline) {
+				var err error
+				if res, err = p.resolveSecretReferenced(test.event); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if res != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, res)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	logLevelDebug logLevel = iota
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	for i, n := range logLevelNames {
+		if n == name {
+			return logLevel(i), nil
+		}
+	}
+	return logLevelInfo, fmt.Errorf("invalid logLevel: %s", name)
+}
+
+type logField struct {
+	key   string
+	value string
+}
+
+// pluginLogger is a leveled logger writing either text or JSON lines.
+// Each line carries the fields attached to the logger, such as the
+// identity of the event source logging it.
+type pluginLogger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  logLevel
+	json   bool
+	fields []logField
+}
+
+func newPluginLogger(out io.Writer, level, format string) (*pluginLogger, error) {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	if format != logFormatText && format != logFormatJSON {
+		return nil, fmt.Errorf("invalid logFormat: %s", format)
+	}
+	return &pluginLogger{
+		mu:    &sync.Mutex{},
+		out:   out,
+		level: lvl,
+		json:  format == logFormatJSON,
+	}, nil
+}
+
+// With returns a logger attaching the given field to each line, in
+// addition to the ones of the parent logger
+func (l *pluginLogger) With(key, value string) *pluginLogger {
+	res := *l
+	res.fields = append(append([]logField{}, l.fields...), logField{key, value})
+	return &res
+}
+
+// WithSource returns a logger attaching the identity of the given event
+// source to each line, as described by sourceIdentity
+func (l *pluginLogger) WithSource(name string) *pluginLogger {
+	scheme, source := sourceIdentity(name)
+	return l.With("scheme", scheme).With("source", source)
+}
+
+func (l *pluginLogger) Debugf(format string, args ...interface{}) {
+	l.logf(logLevelDebug, format, args...)
+}
+
+func (l *pluginLogger) Infof(format string, args ...interface{}) {
+	l.logf(logLevelInfo, format, args...)
+}
+
+func (l *pluginLogger) Warnf(format string, args ...interface{}) {
+	l.logf(logLevelWarn, format, args...)
+}
+
+func (l *pluginLogger) Errorf(format string, args ...interface{}) {
+	l.logf(logLevelError, format, args...)
+}
+
+func (l *pluginLogger) logf(level logLevel, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+	now := time.Now().UTC()
+	msg := fmt.Sprintf(format, args...)
+	var sb strings.Builder
+	if l.json {
+		sb.WriteString(`{"time":`)
+		writeJSONString(&sb, now.Format(time.RFC3339Nano))
+		sb.WriteString(`,"level":`)
+		writeJSONString(&sb, level.String())
+		sb.WriteString(`,"plugin":`)
+		writeJSONString(&sb, pluginName)
+		sb.WriteString(`,"msg":`)
+		writeJSONString(&sb, msg)
+		for _, f := range l.fields {
+			sb.WriteByte(',')
+			writeJSONString(&sb, f.key)
+			sb.WriteByte(':')
+			writeJSONString(&sb, f.value)
+		}
+		sb.WriteString("}\n")
+	} else {
+		// keep the layout of the standard logger used by the other plugins,
+		// with the log.LstdFlags|log.LUTC|log.Lmsgprefix flags
+		sb.WriteString(now.Format("2006/01/02 15:04:05 "))
+		sb.WriteString("[" + pluginName + "] ")
+		sb.WriteString(level.String() + ": " + msg)
+		for _, f := range l.fields {
+			sb.WriteString(" " + f.key + "=" + f.value)
+		}
+		sb.WriteByte('\n')
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.out, sb.String())
+}
+
+func writeJSONString(sb *strings.Builder, s string) {
+	b, _ := json.Marshal(s)
+	sb.Write(b)
+}
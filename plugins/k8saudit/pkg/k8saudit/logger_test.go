@@ -0,0 +1,38 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+)
+
+func TestLoggerTextFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newPluginLogger(&buf, logLevelInfo.String(), logFormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Debugf("not written")
+	logger.WithSource("/var/log/audit.log").Warnf("event %d skipped", 3)
+
+	expected := regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} \[k8saudit\] warn: event 3 skipped scheme=file source=/var/log/audit.log\n$`)
+	if !expected.Match(buf.Bytes()) {
+		t.Errorf("unexpected log line %q", buf.String())
+	}
+}
@@ -0,0 +1,467 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	metricsEndpoint = "/metrics"
+
+	dropReasonParseError = "parse_error"
+	dropReasonDuplicate  = "duplicate"
+	dropReasonOversize   = "oversize"
+	dropReasonOverflow   = "overflow"
+)
+
+var (
+	batchFillBuckets = []float64{0.1, 0.25, 0.5, 0.75, 0.9, 1}
+	ingestLagBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900}
+)
+
+// labelSep separates the label values in the keys of the metric vectors
+const labelSep = "\xff"
+
+// counterVec is a set of counters partitioned by label values. The zero
+// value is ready to use.
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]*uint64
+}
+
+// With returns the counter of the given label values, which can be
+// incremented atomically without looking it up again
+func (c *counterVec) With(labelValues ...string) *uint64 {
+	key := strings.Join(labelValues, labelSep)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]*uint64)
+	}
+	v, ok := c.values[key]
+	if !ok {
+		v = new(uint64)
+		c.values[key] = v
+	}
+	return v
+}
+
+func (c *counterVec) Add(n uint64, labelValues ...string) {
+	atomic.AddUint64(c.With(labelValues...), n)
+}
+
+// Sum returns the sum of the counters of all the label values
+func (c *counterVec) Sum() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sum uint64
+	for _, v := range c.values {
+		sum += atomic.LoadUint64(v)
+	}
+	return sum
+}
+
+// SumWhere returns the sum of the counters having the given value for the
+// label at the given position
+func (c *counterVec) SumWhere(labelIndex int, labelValue string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sum uint64
+	for key, v := range c.values {
+		values := strings.Split(key, labelSep)
+		if labelIndex < len(values) && values[labelIndex] == labelValue {
+			sum += atomic.LoadUint64(v)
+		}
+	}
+	return sum
+}
+
+func (c *counterVec) write(w io.Writer, constLabels []metricLabel, name, help string, labelNames ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(constLabels, labelNames, key), atomic.LoadUint64(c.values[key]))
+	}
+}
+
+// histogramVec is a set of histograms with fixed buckets partitioned by
+// label values. The zero value is ready to use, and tracks only the sum and
+// the count of the observations until the buckets are set.
+type histogramVec struct {
+	mu      sync.Mutex
+	buckets []float64
+	values  map[string]*histogramValue
+}
+
+// histogramValue is the histogram of the observations of given label
+// values. It has its own lock, so that observations of different label
+// values don't contend.
+type histogramValue struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// With returns the histogram of the given label values, which can be
+// observed without looking it up again
+func (h *histogramVec) With(labelValues ...string) *histogramValue {
+	key := strings.Join(labelValues, labelSep)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.values == nil {
+		h.values = make(map[string]*histogramValue)
+	}
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{buckets: h.buckets, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	return hv
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	h.With(labelValues...).Observe(v)
+}
+
+func (hv *histogramValue) Observe(v float64) {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	for i, b := range hv.buckets {
+		if v <= b {
+			hv.counts[i]++
+		}
+	}
+	hv.sum += v
+	hv.count++
+}
+
+// Quantile returns an estimate of the given quantile of the observations
+// of all the label values, by linear interpolation within the bucket in
+// which the quantile falls. Observations above the largest bucket are
+// reported as the largest bucket bound. Returns false if there are no
+// observations or no buckets.
+func (h *histogramVec) Quantile(q float64) (float64, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.buckets) == 0 {
+		return 0, false
+	}
+	counts := make([]uint64, len(h.buckets))
+	var total uint64
+	for _, hv := range h.values {
+		hv.mu.Lock()
+		for i, c := range hv.counts {
+			counts[i] += c
+		}
+		total += hv.count
+		hv.mu.Unlock()
+	}
+	if total == 0 {
+		return 0, false
+	}
+	rank := q * float64(total)
+	lower, prev := 0.0, uint64(0)
+	for i, upper := range h.buckets {
+		if float64(counts[i]) >= rank {
+			inBucket := counts[i] - prev
+			if inBucket == 0 {
+				return upper, true
+			}
+			return lower + (upper-lower)*(rank-float64(prev))/float64(inBucket), true
+		}
+		lower, prev = upper, counts[i]
+	}
+	return h.buckets[len(h.buckets)-1], true
+}
+
+func (h *histogramVec) write(w io.Writer, constLabels []metricLabel, name, help string, labelNames ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hv := h.values[key]
+		hv.mu.Lock()
+		for i, b := range h.buckets {
+			le := strconv.FormatFloat(b, 'g', -1, 64)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(constLabels, append(labelNames, "le"), key+labelSep+le), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(constLabels, append(labelNames, "le"), key+labelSep+"+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", name, formatLabels(constLabels, labelNames, key), hv.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(constLabels, labelNames, key), hv.count)
+		hv.mu.Unlock()
+	}
+}
+
+func sortedKeys(m map[string]*uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricLabel is a label attached to all the series of the metrics
+type metricLabel struct {
+	name  string
+	value string
+}
+
+// formatLabels formats the constant labels, the label names, and the joined
+// label values in the Prometheus text exposition format. The source label
+// is split into the scheme and the source labels, as described by
+// sourceIdentity.
+func formatLabels(constLabels []metricLabel, names []string, key string) string {
+	labels := append([]metricLabel{}, constLabels...)
+	values := strings.Split(key, labelSep)
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		if name == "source" {
+			scheme, source := sourceIdentity(value)
+			labels = append(labels, metricLabel{"scheme", scheme})
+			value = source
+		}
+		labels = append(labels, metricLabel{name, value})
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(l.name)
+		sb.WriteString("=")
+		sb.WriteString(strconv.Quote(l.value))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// sourceIdentity splits the name of an event source into its scheme and
+// its address and path. The name of file sources is their file path, and
+// their scheme is "file".
+func sourceIdentity(name string) (scheme, source string) {
+	if i := strings.Index(name, "://"); i >= 0 {
+		return name[:i], name[i+3:]
+	}
+	return "file", name
+}
+
+// pluginMetrics holds the internal metrics of the plugin. The zero value is
+// ready to use.
+type pluginMetrics struct {
+	messagesReceived counterVec
+	eventsParsed     counterVec
+	eventsEmitted    counterVec
+	eventsDropped    counterVec
+	messagesDropped  counterVec
+	batchFill        histogramVec
+	ingestLag        histogramVec
+	errors           counterVec
+	spansDropped     counterVec
+	constLabels      []metricLabel
+	lastEventTime    int64
+	server           *http.Server
+
+	// queues holds the functions returning the number of items queued in
+	// each opened event source
+	queuesMu sync.Mutex
+	queues   map[string]func() int
+}
+
+// sourceMetrics are the series of the metrics of an event source. They are
+// resolved once when the source is opened, so that updating them for each
+// event doesn't require looking them up by label values.
+type sourceMetrics struct {
+	messagesReceived *uint64
+	eventsParsed     *uint64
+	eventsEmitted    *uint64
+	eventsDropped    map[string]*uint64
+	messagesDropped  map[string]*uint64
+	batchFill        *histogramValue
+	ingestLag        *histogramValue
+}
+
+// Source returns the series of the metrics of the given event source
+func (m *pluginMetrics) Source(source string) *sourceMetrics {
+	s := &sourceMetrics{
+		messagesReceived: m.messagesReceived.With(source),
+		eventsParsed:     m.eventsParsed.With(source),
+		eventsEmitted:    m.eventsEmitted.With(source),
+		eventsDropped:    make(map[string]*uint64),
+		messagesDropped:  make(map[string]*uint64),
+		batchFill:        m.batchFill.With(source),
+		ingestLag:        m.ingestLag.With(source),
+	}
+	for _, reason := range []string{dropReasonParseError, dropReasonDuplicate, dropReasonOversize} {
+		s.eventsDropped[reason] = m.eventsDropped.With(source, reason)
+	}
+	for _, reason := range []string{dropReasonParseError, dropReasonOverflow} {
+		s.messagesDropped[reason] = m.messagesDropped.With(source, reason)
+	}
+	return s
+}
+
+// AddDropped increments the counter of the events dropped for the given reason
+func (s *sourceMetrics) AddDropped(reason string) {
+	atomic.AddUint64(s.eventsDropped[reason], 1)
+}
+
+// AddDroppedMessage increments the counter of the messages dropped as a
+// whole for the given reason. The events of a dropped message are not
+// counted, since they are unknown.
+func (s *sourceMetrics) AddDroppedMessage(reason string) {
+	atomic.AddUint64(s.messagesDropped[reason], 1)
+}
+
+// AddQueue registers a function returning the number of items queued in
+// the given event source
+func (m *pluginMetrics) AddQueue(source string, depth func() int) {
+	m.queuesMu.Lock()
+	defer m.queuesMu.Unlock()
+	if m.queues == nil {
+		m.queues = make(map[string]func() int)
+	}
+	m.queues[source] = depth
+}
+
+// RemoveQueue unregisters the queue of the given event source
+func (m *pluginMetrics) RemoveQueue(source string) {
+	m.queuesMu.Lock()
+	defer m.queuesMu.Unlock()
+	delete(m.queues, source)
+}
+
+// QueueDepth returns the number of items queued in all the opened event
+// sources
+func (m *pluginMetrics) QueueDepth() uint64 {
+	m.queuesMu.Lock()
+	defer m.queuesMu.Unlock()
+	var depth uint64
+	for _, f := range m.queues {
+		depth += uint64(f())
+	}
+	return depth
+}
+
+// init sets up the buckets of the histograms, and the labels attached to
+// all the series
+func (m *pluginMetrics) init(constLabels ...metricLabel) {
+	m.constLabels = constLabels
+	m.batchFill.buckets = batchFillBuckets
+	m.ingestLag.buckets = ingestLagBuckets
+}
+
+// writeText writes all the metrics in the Prometheus text exposition format
+func (m *pluginMetrics) writeText(w io.Writer) {
+	m.messagesReceived.write(w, m.constLabels, pluginName+"_messages_received_total",
+		"Number of raw messages received by the event sources.", "source")
+	m.eventsParsed.write(w, m.constLabels, pluginName+"_events_parsed_total",
+		"Number of audit events parsed from the received messages.", "source")
+	m.eventsEmitted.write(w, m.constLabels, pluginName+"_events_emitted_total",
+		"Number of audit events emitted to Falco.", "source")
+	m.eventsDropped.write(w, m.constLabels, pluginName+"_events_dropped_total",
+		"Number of audit events dropped, by reason.", "source", "reason")
+	m.messagesDropped.write(w, m.constLabels, pluginName+"_messages_dropped_total",
+		"Number of raw messages dropped as a whole before their audit events are parsed, by reason.", "source", "reason")
+	m.batchFill.write(w, m.constLabels, pluginName+"_batch_fill_ratio",
+		"Ratio of the event batch capacity filled by each non-empty batch.", "source")
+	m.ingestLag.write(w, m.constLabels, pluginName+"_ingest_lag_seconds",
+		"Time elapsed between the stageTimestamp of the audit events and their emission to Falco.", "source")
+	m.errors.write(w, m.constLabels, pluginName+"_errors_total",
+		"Number of failures, by category (transport, auth, json_parse, schema, oversize, overflow).", "category")
+	m.spansDropped.write(w, m.constLabels, pluginName+"_trace_spans_dropped_total",
+		"Number of trace spans dropped because the export queue was full.")
+
+	m.queuesMu.Lock()
+	defer m.queuesMu.Unlock()
+	name := pluginName + "_queue_depth"
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, "Number of messages and audit events queued in the event source.", name)
+	sources := make([]string, 0, len(m.queues))
+	for source := range m.queues {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(m.constLabels, []string{"source"}, source), m.queues[source]())
+	}
+}
+
+// Serve starts serving the metrics over HTTP on the given address. If
+// enablePprof is true, the runtime profiling data is served too under
+// the /debug/pprof/ endpoints.
+func (m *pluginMetrics) Serve(address string, enablePprof bool, logger *pluginLogger) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsEndpoint, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.writeText(w)
+	})
+	if enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	m.server = &http.Server{Handler: mux}
+	go func() {
+		if err := m.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("metrics server error: %s", err.Error())
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops serving the metrics over HTTP, if started
+func (m *pluginMetrics) Shutdown() {
+	if m.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*webServerShutdownTimeoutSecs)
+		defer cancel()
+		m.server.Shutdown(ctx)
+		m.server = nil
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSourceMetrics(t *testing.T) {
+	var m pluginMetrics
+	m.init(metricLabel{"cluster", "test"})
+
+	s := m.Source("http://:9765/k8s-audit")
+	*s.messagesReceived++
+	*s.eventsParsed += 3
+	*s.eventsEmitted += 2
+	s.AddDropped(dropReasonDuplicate)
+	s.AddDroppedMessage(dropReasonParseError)
+	s.batchFill.Observe(0.5)
+
+	// series of the same source are shared
+	if m.Source("http://:9765/k8s-audit").eventsEmitted != s.eventsEmitted {
+		t.Errorf("expected the series of a source to be shared")
+	}
+	if n := m.eventsDropped.SumWhere(1, dropReasonDuplicate); n != 1 {
+		t.Errorf("expected 1 duplicate drop, got %d", n)
+	}
+	if n := m.eventsDropped.Sum(); n != 1 {
+		t.Errorf("expected 1 drop, got %d", n)
+	}
+
+	var buf bytes.Buffer
+	m.writeText(&buf)
+	labels := `cluster="test",scheme="http",source=":9765/k8s-audit"`
+	for _, line := range []string{
+		fmt.Sprintf("k8saudit_messages_received_total{%s} 1", labels),
+		fmt.Sprintf("k8saudit_events_parsed_total{%s} 3", labels),
+		fmt.Sprintf("k8saudit_events_emitted_total{%s} 2", labels),
+		fmt.Sprintf(`k8saudit_events_dropped_total{%s,reason="duplicate"} 1`, labels),
+		fmt.Sprintf(`k8saudit_messages_dropped_total{%s,reason="overflow"} 0`, labels),
+		fmt.Sprintf(`k8saudit_messages_dropped_total{%s,reason="parse_error"} 1`, labels),
+		fmt.Sprintf(`k8saudit_batch_fill_ratio_bucket{%s,le="0.5"} 1`, labels),
+		fmt.Sprintf("k8saudit_batch_fill_ratio_count{%s} 1", labels),
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("expected line %q in:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestInitFailureReleasesMetrics(t *testing.T) {
+	// reserve a free address for the metrics server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	// the dedup store can't be created in a missing directory
+	dedupPath := filepath.Join(t.TempDir(), "missing", "dedup")
+	p := &Plugin{}
+	err = p.Init(fmt.Sprintf(`{"metricsAddress":%q,"summaryIntervalSecs":1,"dedupStorePath":%q}`, address, dedupPath))
+	if err == nil {
+		p.Destroy()
+		t.Fatal("expected Init to fail")
+	}
+	if p.metrics.server != nil || p.stopSummary != nil {
+		t.Errorf("expected the metrics server and the summary log not to be running")
+	}
+
+	// the address must still be available
+	l, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("expected the metrics address to be released: %s", err.Error())
+	}
+	l.Close()
+}
@@ -0,0 +1,94 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	overflowPolicyBlock      = "block"
+	overflowPolicyDropNewest = "dropNewest"
+	overflowPolicyDropOldest = "dropOldest"
+
+	overflowLogInterval = 10 * time.Second
+)
+
+func validateOverflowPolicy(policy string) error {
+	switch policy {
+	case overflowPolicyBlock, overflowPolicyDropNewest, overflowPolicyDropOldest:
+		return nil
+	}
+	return fmt.Errorf("invalid overflowPolicy: %s", policy)
+}
+
+// overflowStats counts the webhook messages dropped because the ingest
+// pipeline was saturated, for each drop policy.
+type overflowStats struct {
+	droppedNewest uint64
+	droppedOldest uint64
+	lastLog       int64
+}
+
+// enqueueMessage sends a webhook message to the event channel, applying
+// the configured overflow policy if the channel is full.
+func (k *Plugin) enqueueMessage(name string, eventChan chan sourceMessage, msg sourceMessage) {
+	switch k.Config.OverflowPolicy {
+	case overflowPolicyDropNewest:
+		select {
+		case eventChan <- msg:
+		default:
+			atomic.AddUint64(&k.overflow.droppedNewest, 1)
+			k.metrics.messagesDropped.Add(1, name, dropReasonOverflow)
+			k.countError(errorCategoryOverflow)
+			k.logOverflow()
+		}
+	case overflowPolicyDropOldest:
+		for {
+			select {
+			case eventChan <- msg:
+				return
+			default:
+			}
+			select {
+			case <-eventChan:
+				atomic.AddUint64(&k.overflow.droppedOldest, 1)
+				k.metrics.messagesDropped.Add(1, name, dropReasonOverflow)
+				k.countError(errorCategoryOverflow)
+				k.logOverflow()
+			default:
+			}
+		}
+	default:
+		eventChan <- msg
+	}
+}
+
+// logOverflow logs the drop counters, at most once per overflowLogInterval
+func (k *Plugin) logOverflow() {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&k.overflow.lastLog)
+	if now-last < int64(overflowLogInterval) || !atomic.CompareAndSwapInt64(&k.overflow.lastLog, last, now) {
+		return
+	}
+	k.logger.Warnf("webhook queue is full, dropping requests: policy=%s, droppedNewest=%d, droppedOldest=%d",
+		k.Config.OverflowPolicy,
+		atomic.LoadUint64(&k.overflow.droppedNewest),
+		atomic.LoadUint64(&k.overflow.droppedOldest))
+}
@@ -0,0 +1,94 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEnqueueMessageOverflow(t *testing.T) {
+	tests := []struct {
+		policy        string
+		queued        string
+		droppedNewest uint64
+		droppedOldest uint64
+	}{
+		{overflowPolicyDropNewest, "[1 2]", 2, 0},
+		{overflowPolicyDropOldest, "[3 4]", 0, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			p := &Plugin{logger: testLogger(t)}
+			p.Config.OverflowPolicy = test.policy
+			eventChan := make(chan sourceMessage, 2)
+			for i := 1; i <= 4; i++ {
+				p.enqueueMessage("test", eventChan, sourceMessage{data: []byte(fmt.Sprint(i))})
+			}
+			close(eventChan)
+			var queued []string
+			for msg := range eventChan {
+				queued = append(queued, string(msg.data))
+			}
+			if fmt.Sprint(queued) != test.queued {
+				t.Errorf("expected queued messages %s, got %v", test.queued, queued)
+			}
+			if p.overflow.droppedNewest != test.droppedNewest || p.overflow.droppedOldest != test.droppedOldest {
+				t.Errorf("unexpected drop counters: newest=%d, oldest=%d", p.overflow.droppedNewest, p.overflow.droppedOldest)
+			}
+			if n := p.metrics.messagesDropped.SumWhere(1, dropReasonOverflow); n != 2 {
+				t.Errorf("expected 2 overflow drops in the metrics, got %d", n)
+			}
+			if n := p.metrics.eventsDropped.Sum(); n != 0 {
+				t.Errorf("expected the dropped messages not to be counted as events, got %d", n)
+			}
+			if n := p.metrics.errors.SumWhere(0, errorCategoryOverflow); n != 2 {
+				t.Errorf("expected 2 overflow errors in the metrics, got %d", n)
+			}
+		})
+	}
+}
+
+func TestEnqueueMessageBlock(t *testing.T) {
+	p := &Plugin{logger: testLogger(t)}
+	p.Config.OverflowPolicy = overflowPolicyBlock
+	eventChan := make(chan sourceMessage, 1)
+	p.enqueueMessage("test", eventChan, sourceMessage{data: []byte("1")})
+
+	// the message is not dropped, and waits for the queue to have room
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.enqueueMessage("test", eventChan, sourceMessage{data: []byte("2")})
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected enqueueing to block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if msg := <-eventChan; string(msg.data) != "1" {
+		t.Errorf("expected message 1, got %s", msg.data)
+	}
+	<-done
+	if msg := <-eventChan; string(msg.data) != "2" {
+		t.Errorf("expected message 2, got %s", msg.data)
+	}
+	if n := p.metrics.messagesDropped.Sum(); n != 0 {
+		t.Errorf("expected no drops, got %d", n)
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"sync/atomic"
+
+	"github.com/valyala/fastjson"
+)
+
+// parserPool is the pool of the parsers used by the event sources to parse
+// the received messages
+var parserPool fastjson.ParserPool
+
+// parsedMessage is a JSON message parsed with a pooled parser. The values
+// of the message are backed by the memory of the parser, which is returned
+// to the pool once all the events of the message have been released.
+type parsedMessage struct {
+	parser *fastjson.Parser
+	refs   int32
+}
+
+// parseMessage parses a JSON message with a parser taken from the pool.
+// The parser is owned by the returned message.
+func parseMessage(data []byte) (*fastjson.Value, *parsedMessage, error) {
+	parser := parserPool.Get()
+	value, err := parser.ParseBytes(data)
+	if err != nil {
+		parserPool.Put(parser)
+		return nil, nil, err
+	}
+	return value, &parsedMessage{parser: parser}, nil
+}
+
+// attach binds the events to the message, so that the parser is returned to
+// the pool once all of them are released. The parser is returned right away
+// if there are no events. The message must not be used by the caller anymore.
+func (m *parsedMessage) attach(events []*auditEvent) {
+	if len(events) == 0 {
+		parserPool.Put(m.parser)
+		return
+	}
+	m.refs = int32(len(events))
+	for _, e := range events {
+		e.msg = m
+	}
+}
+
+// release signals that the event data is not used anymore. The event data
+// must not be accessed after this call.
+func (e *auditEvent) release() {
+	if e.msg != nil {
+		if atomic.AddInt32(&e.msg.refs, -1) == 0 {
+			parserPool.Put(e.msg.parser)
+		}
+		e.msg = nil
+	}
+}
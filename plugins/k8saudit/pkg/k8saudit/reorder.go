@@ -0,0 +1,120 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"container/heap"
+	"context"
+	"time"
+)
+
+// auditEventHeap is a min-heap of audit events ordered by timestamp
+type auditEventHeap []*auditEvent
+
+func (h auditEventHeap) Len() int            { return len(h) }
+func (h auditEventHeap) Less(i, j int) bool  { return h[i].Timestamp.Before(h[j].Timestamp) }
+func (h auditEventHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *auditEventHeap) Push(x interface{}) { *h = append(*h, x.(*auditEvent)) }
+func (h *auditEventHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return x
+}
+
+// reorderEvents buffers the events received from eventChan and forwards
+// them sorted by timestamp. An event is forwarded once an event more recent
+// by at least the given window has been received, or once no event has been
+// received for the duration of the window. Errors received from errorChan
+// are forwarded after flushing all the buffered events.
+func reorderEvents(ctx context.Context, window time.Duration, eventChan <-chan []*auditEvent, errorChan <-chan error) (<-chan []*auditEvent, <-chan error) {
+	outEventChan := make(chan []*auditEvent)
+	outErrorChan := make(chan error)
+	go func() {
+		defer close(outEventChan)
+		defer close(outErrorChan)
+		var buf auditEventHeap
+		var latest time.Time
+		idle := time.NewTimer(window)
+		defer idle.Stop()
+
+		// send the buffered events with a timestamp older than the given one
+		flush := func(before time.Time) bool {
+			var evs []*auditEvent
+			for len(buf) > 0 && !buf[0].Timestamp.After(before) {
+				evs = append(evs, heap.Pop(&buf).(*auditEvent))
+			}
+			if len(evs) == 0 {
+				return true
+			}
+			select {
+			case outEventChan <- evs:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		flushAll := func() bool {
+			return flush(latest)
+		}
+
+		for {
+			select {
+			case evs, ok := <-eventChan:
+				if !ok {
+					flushAll()
+					return
+				}
+				for _, ev := range evs {
+					heap.Push(&buf, ev)
+					if ev.Timestamp.After(latest) {
+						latest = ev.Timestamp
+					}
+				}
+				if !flush(latest.Add(-window)) {
+					return
+				}
+				if !idle.Stop() {
+					select {
+					case <-idle.C:
+					default:
+					}
+				}
+				idle.Reset(window)
+			case <-idle.C:
+				if !flushAll() {
+					return
+				}
+				idle.Reset(window)
+			case err, ok := <-errorChan:
+				if !flushAll() || !ok {
+					return
+				}
+				select {
+				case outErrorChan <- err:
+				case <-ctx.Done():
+				}
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return outEventChan, outErrorChan
+}
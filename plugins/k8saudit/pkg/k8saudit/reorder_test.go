@@ -0,0 +1,106 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReorderEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	eventChan := make(chan []*auditEvent)
+	errorChan := make(chan error)
+	window := time.Second
+	outEventChan, outErrorChan := reorderEvents(ctx, window, eventChan, errorChan)
+
+	base := time.Now()
+	event := func(offset time.Duration) *auditEvent {
+		return &auditEvent{Timestamp: base.Add(offset)}
+	}
+	readOffsets := func() []time.Duration {
+		var res []time.Duration
+		select {
+		case evs := <-outEventChan:
+			for _, ev := range evs {
+				res = append(res, ev.Timestamp.Sub(base))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for events")
+		}
+		return res
+	}
+
+	// events within the window are buffered and sorted, and are forwarded
+	// once an event more recent by at least the window is received
+	eventChan <- []*auditEvent{event(300 * time.Millisecond), event(100 * time.Millisecond)}
+	eventChan <- []*auditEvent{event(200 * time.Millisecond)}
+	eventChan <- []*auditEvent{event(1250 * time.Millisecond)}
+	got := readOffsets()
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}
+	if len(got) != len(expected) || got[0] != expected[0] || got[1] != expected[1] {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	// errors are forwarded after flushing all the buffered events
+	errorChan <- errors.New("test")
+	got = readOffsets()
+	expected = []time.Duration{300 * time.Millisecond, 1250 * time.Millisecond}
+	if len(got) != len(expected) || got[0] != expected[0] || got[1] != expected[1] {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	if err := <-outErrorChan; err == nil || err.Error() != "test" {
+		t.Errorf("expected the forwarded error, got %v", err)
+	}
+}
+
+func TestReorderEventsIdle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	eventChan := make(chan []*auditEvent)
+	window := 50 * time.Millisecond
+	outEventChan, _ := reorderEvents(ctx, window, eventChan, make(chan error))
+
+	// buffered events are forwarded once no event is received for the
+	// duration of the window
+	start := time.Now()
+	eventChan <- []*auditEvent{{Timestamp: start}}
+	select {
+	case evs := <-outEventChan:
+		if len(evs) != 1 {
+			t.Errorf("expected 1 event, got %d", len(evs))
+		}
+		if time.Since(start) < window {
+			t.Errorf("expected the event to be buffered for the window")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the idle flush")
+	}
+
+	// buffered events are flushed when the input is closed
+	eventChan <- []*auditEvent{{Timestamp: start}}
+	close(eventChan)
+	if evs := <-outEventChan; len(evs) != 1 {
+		t.Errorf("expected 1 event on close, got %d", len(evs))
+	}
+	if _, ok := <-outEventChan; ok {
+		t.Errorf("expected the output to be closed")
+	}
+}
@@ -18,13 +18,21 @@ package k8saudit
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/falcosecurity/plugin-sdk-go/pkg/sdk"
@@ -32,24 +40,72 @@ import (
 	"github.com/valyala/fastjson"
 )
 
-var defaultEventTimeout = 30 * time.Millisecond
+var (
+	defaultEventTimeout = 30 * time.Millisecond
+	gzipMagic           = []byte{0x1f, 0x8b}
+)
+
+const (
+	fileEOFClose  = "close"
+	fileEOFFollow = "follow"
+	fileEOFIdle   = "idle"
+
+	fileFollowPollInterval = 250 * time.Millisecond
+)
 
 const (
 	webServerShutdownTimeoutSecs = 5
 	webServerEventChanBufSize    = 50
+	redactedValue                = "<redacted>"
 )
 
 type auditEvent struct {
 	Data      *fastjson.Value
 	Timestamp time.Time
+
+	// Raw contains the original bytes of the event, only set if the event
+	// is the whole received message and has not been modified since, so
+	// that it can be written as-is without being serialized again
+	Raw []byte
+
+	// Received and Parsed are the times at which the receipt of the message
+	// containing the event has started and at which the message has been
+	// parsed, only set if tracing is enabled
+	Received time.Time
+	Parsed   time.Time
+
+	// msg is the message backing the event data, if it has been parsed
+	// with a pooled parser
+	msg *parsedMessage
+
+	// dedupKey identifies the event in the dedup store, if enabled
+	dedupKey string
+
+	// ack tracks the delivery of the message containing the event, if its
+	// position needs to be committed
+	ack *messageAck
+
+	// synthetic is true for the events injected by the plugin itself, such
+	// as heartbeats, whose plugin annotations are trusted
+	synthetic bool
 }
 
 type eventSource struct {
 	source.BaseInstance
-	eventChan <-chan *auditEvent
+	name      string
+	logger    *pluginLogger
+	metrics   *pluginMetrics
+	series    *sourceMetrics
+	eventChan <-chan []*auditEvent
 	errorChan <-chan error
+	pending   []*auditEvent
+	queued    *int64
 	ctx       context.Context
 	cancel    func()
+	progress  func() (float64, string)
+	timeout   time.Duration
+	bufSize   int
+	idleAtEOF bool
 	eof       bool
 }
 
@@ -60,10 +116,12 @@ func (k *Plugin) Open(params string) (source.Instance, error) {
 	}
 
 	switch u.Scheme {
-	case "http":
-		return k.OpenWebServer(u.Host, u.Path, false)
-	case "https":
-		return k.OpenWebServer(u.Host, u.Path, true)
+	case "http", "https":
+		batchSize, err := k.openBatchSize(u.Query())
+		if err != nil {
+			return nil, err
+		}
+		return k.openWebServer(u.Host, u.Path, u.Scheme == "https", batchSize)
 	case "": // // by default, fallback to opening a filepath
 		return k.OpenFilePath(params)
 	}
@@ -71,47 +129,326 @@ func (k *Plugin) Open(params string) (source.Instance, error) {
 	return nil, fmt.Errorf(`scheme "%s" is not supported`, u.Scheme)
 }
 
+// openBatchSize returns the batch size of a webhook event source, which
+// defaults to the batchSize configuration and can be overridden with the
+// batchSize query parameter of the open params. Other query parameters
+// are ignored.
+func (k *Plugin) openBatchSize(query url.Values) (uint64, error) {
+	if len(query.Get("batchSize")) == 0 {
+		return k.Config.BatchSize, nil
+	}
+	batchSize, err := strconv.ParseUint(query.Get("batchSize"), 10, 64)
+	if err != nil || batchSize == 0 {
+		return 0, fmt.Errorf("invalid batchSize open parameter: %s", query.Get("batchSize"))
+	}
+	return batchSize, nil
+}
+
 // OpenFilePath opens parameters with no prefix, which represent one
-// or more JSON objects encoded with JSONLine notation in a file on the
-// local filesystem. Each JSON object produces an event in the returned
-// event source.
+// or more JSON objects in a file on the local filesystem. The JSON objects
+// can be encoded with JSONLine notation, or be concatenated or pretty-printed
+// over multiple lines. Each JSON object produces an event in the returned
+// event source. Gzip-compressed files are decompressed transparently, and
+// a leading header object not containing audit events is skipped, so that
+// gzip NDJSON capture archives can be replayed as they are. Malformed JSON
+// objects are skipped up to the next line starting with an object, and
+// are written to the dead-letter file if enabled. If checkpointing
+// is enabled, the read offset of uncompressed files is persisted, and
+// reading resumes from it when the same file is opened again. The read
+// progress of regular files is reported as the ratio of bytes consumed.
+// What happens at the end of the file depends on the fileEOFBehavior
+// configuration.
 func (k *Plugin) OpenFilePath(filePath string) (source.Instance, error) {
+	filePath, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, err
+	}
 	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, err
 	}
-	eventChan := make(chan []byte)
+
+	// resume from the last checkpoint, if any
+	var checkpoint *fileCheckpoint
+	if k.checkpoints != nil {
+		checkpoint, err = k.openFileCheckpoint(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if checkpoint.Offset > 0 {
+			k.logger.WithSource(file.Name()).Infof("resuming file from offset %d", checkpoint.Offset)
+		}
+	}
+
+	// track the amount of bytes read from the file to report the progress
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	counter := &countingReader{r: file}
+	if checkpoint != nil {
+		counter.n = checkpoint.Offset
+	}
+
+	// in follow mode, wait for new data at EOF until the source is closed
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	bufReader := bufio.NewReader(counter)
+	var reader io.Reader = bufReader
+	if k.Config.FileEOFBehavior == fileEOFFollow {
+		reader = &followReader{ctx: ctx, r: bufReader}
+	}
+
+	isGzip := false
+	if magic, err := bufReader.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		reader, err = gzip.NewReader(reader)
+		if err != nil {
+			cancelCtx()
+			file.Close()
+			return nil, err
+		}
+		// offsets are not meaningful in compressed files
+		isGzip = true
+		checkpoint = nil
+	}
+
+	// the offset of each message is committed to the checkpoint only once
+	// all its events have been emitted, and the checkpoint is saved
+	// periodically and when the source is closed
+	var commits *commitQueue
+	var lastSave time.Time
+	onClose := cancelCtx
+	if checkpoint != nil {
+		commits = newCommitQueue()
+		onClose = func() {
+			cancelCtx()
+			commits.Do(func() { k.saveFileCheckpoint(file.Name(), checkpoint) })
+		}
+	}
+
+	eventChan := make(chan sourceMessage)
 	errorChan := make(chan error)
 	go func() {
 		defer file.Close()
 		defer close(eventChan)
 		defer close(errorChan)
-		scanner := bufio.NewScanner(file)
-		scanner.Split(bufio.ScanLines)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if len(line) > 0 {
-				eventChan <- ([]byte)(line)
+		var baseOffset int64
+		if checkpoint != nil {
+			baseOffset = checkpoint.Offset
+		}
+		commitOffset := func(offset int64) func() {
+			if checkpoint == nil {
+				return nil
 			}
+			return commits.Add(func() {
+				checkpoint.Offset = offset
+				if time.Since(lastSave) > checkpointSaveInterval {
+					k.saveFileCheckpoint(file.Name(), checkpoint)
+					lastSave = time.Now()
+				}
+			})
 		}
-		if scanner.Err() != nil {
-			errorChan <- err
+		logger := k.logger.WithSource(file.Name())
+		decoder := json.NewDecoder(reader)
+		for first := true; ; first = false {
+			var msg json.RawMessage
+			if err := decoder.Decode(&msg); err != nil {
+				if _, ok := err.(*json.SyntaxError); ok {
+					// skip the malformed payload, and resume decoding from
+					// the beginning of the next object
+					k.countError(errorCategoryJSONParse)
+					reader = io.MultiReader(decoder.Buffered(), reader)
+					payload, skipped, resync, skipErr := skipMalformedJSON(reader, int(k.Config.MaxEventSize))
+					logger.Warnf("skipped malformed JSON at offset %d: %s", baseOffset+decoder.InputOffset(), err.Error())
+					k.metrics.messagesDropped.Add(1, file.Name(), dropReasonParseError)
+					k.writeDeadLetter(err, payload)
+					baseOffset += decoder.InputOffset() + skipped
+					if done := commitOffset(baseOffset); done != nil {
+						done()
+					}
+					if skipErr != nil {
+						if skipErr != io.EOF {
+							k.countError(decodeErrorCategory(skipErr))
+							errorChan <- skipErr
+						}
+						return
+					}
+					if resync {
+						reader = io.MultiReader(bytes.NewReader([]byte{'{'}), reader)
+						baseOffset--
+					}
+					decoder = json.NewDecoder(reader)
+					continue
+				}
+				if err != io.EOF {
+					k.countError(decodeErrorCategory(err))
+					errorChan <- err
+				}
+				return
+			}
+			if first && isGzip && isCaptureHeader(msg) {
+				continue
+			}
+			done := commitOffset(baseOffset + decoder.InputOffset())
+			select {
+			case eventChan <- sourceMessage{data: msg, done: done, received: time.Now()}:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
-	return k.openEventSource(context.Background(), eventChan, errorChan, nil)
+	res, err := k.openEventSource(ctx, file.Name(), k.Config.BatchSize, eventChan, errorChan, onClose)
+	if err != nil {
+		return nil, err
+	}
+	res.(*eventSource).idleAtEOF = k.Config.FileEOFBehavior == fileEOFIdle
+	if info.Mode().IsRegular() && info.Size() > 0 {
+		res.(*eventSource).progress = func() (float64, string) {
+			read := counter.Count()
+			pd := float64(read) / float64(info.Size())
+			return pd, fmt.Sprintf("%.2f%% - %v/%v bytes", pd*100, read, info.Size())
+		}
+	}
+	return res, nil
+}
+
+// skipMalformedJSON consumes a malformed JSON value from r, up to the next
+// line starting with a '{' character, which is likely to be the beginning
+// of the next top-level object. Returns the skipped payload, truncated to
+// maxSize bytes, and the number of bytes consumed. If resync is true, the
+// '{' character has been consumed too, and is counted in the total.
+func skipMalformedJSON(r io.Reader, maxSize int) (payload []byte, n int64, resync bool, err error) {
+	var b [1]byte
+	started, newLine := false, false
+	for {
+		if _, err = io.ReadFull(r, b[:]); err != nil {
+			return bytes.TrimSpace(payload), n, false, err
+		}
+		n++
+		if !started {
+			// leading whitespace precedes the malformed value
+			if b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n' {
+				continue
+			}
+			started = true
+		} else if newLine && b[0] == '{' {
+			return bytes.TrimSpace(payload), n, true, nil
+		}
+		newLine = b[0] == '\n'
+		if len(payload) < maxSize {
+			payload = append(payload, b[0])
+		}
+	}
+}
+
+// followReader is an io.Reader that, instead of returning io.EOF, waits
+// for more data to be available until its context is cancelled
+type followReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (f *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := f.r.Read(p)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		select {
+		case <-f.ctx.Done():
+			return 0, io.EOF
+		case <-time.After(fileFollowPollInterval):
+		}
+	}
+}
+
+// countingReader is an io.Reader counting the amount of bytes read
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func (c *countingReader) Count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// openFileCheckpoint loads the checkpoint of an opened file and seeks
+// the file to the checkpointed offset. If no checkpoint is available,
+// a new one is returned starting at the beginning of the file.
+func (k *Plugin) openFileCheckpoint(file *os.File) (*fileCheckpoint, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	checkpoint, err := k.checkpoints.Load(file.Name(), info)
+	if err != nil {
+		return nil, err
+	}
+	if checkpoint == nil {
+		return &fileCheckpoint{Inode: fileInode(info)}, nil
+	}
+	if _, err := file.Seek(checkpoint.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+func (k *Plugin) saveFileCheckpoint(filePath string, checkpoint *fileCheckpoint) {
+	if err := k.checkpoints.Save(filePath, checkpoint); err != nil {
+		k.logger.Warnf("can't save checkpoint of file %s: %s", filePath, err.Error())
+	}
+}
+
+// isCaptureHeader returns true if the given JSON message is an object that
+// does not contain any audit event, such as the metadata header of
+// capture archives.
+func isCaptureHeader(msg []byte) bool {
+	value, err := fastjson.ParseBytes(msg)
+	return err == nil &&
+		value.Type() == fastjson.TypeObject &&
+		value.Get("kind") == nil &&
+		value.Get("auditID") == nil
 }
 
 // OpenWebServer opens parameters with "http://" and "https://" prefixes.
 // Starts a webserver and listens for K8S Audit Event webhooks.
 func (k *Plugin) OpenWebServer(address, endpoint string, ssl bool) (source.Instance, error) {
+	return k.openWebServer(address, endpoint, ssl, k.Config.BatchSize)
+}
+
+func (k *Plugin) openWebServer(address, endpoint string, ssl bool, batchSize uint64) (source.Instance, error) {
 	ctx, cancelCtx := context.WithCancel(context.Background())
-	eventChan := make(chan []byte, webServerEventChanBufSize)
+	eventChan := make(chan sourceMessage, k.Config.WebhookChanBufSize)
+	name := "http://" + address + endpoint
+	if ssl {
+		name = "https://" + address + endpoint
+	}
+	logger := k.logger.WithSource(name)
 	errorChan := make(chan error)
 
+	// optionally, route the received messages through a persistent queue
+	var spool *diskSpool
+	if len(k.Config.WebhookSpoolDir) > 0 {
+		var err error
+		spool, err = openDiskSpool(k.Config.WebhookSpoolDir, int64(k.Config.WebhookSpoolMaxSize), int64(k.Config.WebhookMaxBatchSize), logger)
+		if err != nil {
+			cancelCtx()
+			return nil, err
+		}
+	}
+
 	// configure server
 	m := http.NewServeMux()
 	s := &http.Server{Addr: address, Handler: m}
 	m.HandleFunc(endpoint, func(w http.ResponseWriter, req *http.Request) {
+		received := time.Now()
 		if req.Method != "POST" {
 			http.Error(w, fmt.Sprintf("%s method not allowed", req.Method), http.StatusMethodNotAllowed)
 			return
@@ -123,19 +460,51 @@ func (k *Plugin) OpenWebServer(address, endpoint string, ssl bool) (source.Insta
 		req.Body = http.MaxBytesReader(w, req.Body, int64(k.Config.WebhookMaxBatchSize))
 		bytes, err := ioutil.ReadAll(req.Body)
 		if err != nil {
+			k.countError(readErrorCategory(err))
 			msg := fmt.Sprintf("bad request: %s", err.Error())
-			k.logger.Println(msg)
+			logger.Warnf("%s", msg)
 			http.Error(w, msg, http.StatusBadRequest)
 			return
 		}
+		if spool != nil {
+			if err := spool.Write(bytes); err != nil {
+				k.metrics.messagesDropped.Add(1, name, dropReasonOverflow)
+				if err == errSpoolFull {
+					k.countError(errorCategoryOverflow)
+				} else {
+					k.countError(errorCategoryTransport)
+				}
+				msg := fmt.Sprintf("can't queue request: %s", err.Error())
+				logger.Warnf("%s", msg)
+				http.Error(w, msg, http.StatusServiceUnavailable)
+				return
+			}
+		}
 		w.WriteHeader(http.StatusOK)
-		eventChan <- bytes
+		if spool == nil {
+			k.enqueueMessage(name, eventChan, sourceMessage{data: bytes, received: received})
+		}
 	})
 
-	// launch server
+	// launch the persistent queue consumer, and the server. The error
+	// channel is closed once both are done
+	var wg sync.WaitGroup
+	if spool != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := spool.Run(ctx, eventChan); err != nil {
+				k.countError(errorCategoryTransport)
+				select {
+				case errorChan <- err:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+	wg.Add(1)
 	go func() {
-		//defer close(eventChan)
-		defer close(errorChan)
+		defer wg.Done()
 		var err error
 		if ssl {
 			// note: the legacy K8S Audit implementation concatenated the key and cert PEM
@@ -146,9 +515,14 @@ func (k *Plugin) OpenWebServer(address, endpoint string, ssl bool) (source.Insta
 			err = s.ListenAndServe()
 		}
 		if err != nil && err != http.ErrServerClosed {
+			k.countError(errorCategoryTransport)
 			errorChan <- err
 		}
 	}()
+	go func() {
+		wg.Wait()
+		close(errorChan)
+	}()
 
 	// on close, shutdown the webserver gracefully with, and wait for it with a timeout
 	onClose := func() {
@@ -159,56 +533,202 @@ func (k *Plugin) OpenWebServer(address, endpoint string, ssl bool) (source.Insta
 	}
 
 	// open the event source
-	return k.openEventSource(ctx, eventChan, errorChan, onClose)
+	return k.openEventSource(ctx, name, batchSize, eventChan, errorChan, onClose)
 }
 
-// todo: optimize this to cache by event number
 func (k *Plugin) String(evt sdk.EventReader) (string, error) {
 	evtBytes, err := ioutil.ReadAll(evt.Reader())
 	if err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("%v", string(evtBytes)), nil
+	return string(evtBytes), nil
 }
 
 // openEventSource opens the K8S Audit Logs event source returns a
 // source.Instance. ctx is the context of the event source, so cancelling
-// it will result in an EOF. EventChan is the channel from which the K8S
+// it will result in an EOF. Name identifies the event source in the
+// metrics and logs. BatchSize is the maximum number of events returned by
+// each NextBatch call. EventChan is the channel from which the K8S
 // Audit digests are received as raw bytes. For reference, this is the body
-// of K8S Audit webhooks or dump files. ErrorChan is a channel that can be
+// of K8S Audit webhooks or dump files. The done callback of each message is
+// invoked once all its events have been emitted or dropped. ErrorChan is a channel that can be
 // used to propagate errors in the event source. The event source returns the
 // errors it receives, so any error would cause it to be closed by the
 // framwork. TimeoutMillis is the time interval (in milliseconds) after
 // which a sdk.Timeout error is returned by NextBatch when no new event is
 // received during that timeframe. OnClose is a callback that is invoked when
 // the event source is closed by the plugin framework.
-func (k *Plugin) openEventSource(ctx context.Context, eventChan <-chan []byte, errorChan <-chan error, onClose func()) (source.Instance, error) {
+func (k *Plugin) openEventSource(ctx context.Context, name string, batchSize uint64, eventChan <-chan sourceMessage, errorChan <-chan error, onClose func()) (source.Instance, error) {
 	// Launch the parsing goroutine that receives raw byte messages.
 	// One or more audit events can be extracted from each message.
-	newEventChan := make(chan *auditEvent)
+	// The events are handed off in batches, so that messages expanding into
+	// many events don't cost a channel operation per event.
+	newEventChan := make(chan []*auditEvent, k.Config.EventChanBufSize)
 	newErrorChan := make(chan error)
+	logger := k.logger.WithSource(name)
+	series := k.metrics.Source(name)
+	queued := new(int64)
 	go func() {
 		defer close(newEventChan)
 		defer close(newErrorChan)
-		for {
-			select {
-			case bytes, ok := <-eventChan:
-				if !ok {
+		var received, parsed time.Time
+		var pending []*auditEvent
+		var ack *messageAck
+		// the events of a spilled message are sent by a separate reader,
+		// which must be done before sending the events that follow them
+		var spillDone chan struct{}
+		waitSpill := func() {
+			if spillDone != nil {
+				<-spillDone
+				spillDone = nil
+			}
+		}
+		defer waitSpill()
+		flushEvents := func() {
+			if len(pending) > 0 {
+				waitSpill()
+				atomic.AddInt64(queued, int64(len(pending)))
+				newEventChan <- pending
+				pending = nil
+			}
+		}
+		prepareEvent := func(v *auditEvent, ack *messageAck) bool {
+			if k.isDuplicate(v) {
+				series.AddDropped(dropReasonDuplicate)
+				v.release()
+				return false
+			}
+			// the annotations reserved to the plugin can't be trusted if
+			// they come from the sender of the event
+			if !v.synthetic && removeEnrichAnnotations(v.Data) {
+				v.Raw = nil
+			}
+			if k.enrichEvent(v.Data) {
+				v.Raw = nil
+			}
+			ack.add(v)
+			return true
+		}
+		sendEvent := func(v *auditEvent) {
+			v.Received, v.Parsed = received, parsed
+			if !prepareEvent(v, ack) {
+				return
+			}
+			pending = append(pending, v)
+			if uint64(len(pending)) >= batchSize {
+				flushEvents()
+			}
+		}
+		// handleMessage parses a message and sends its events
+		handleMessage := func(bytes []byte) {
+			atomic.AddUint64(series.messagesReceived, 1)
+			if k.tracer != nil && received.IsZero() {
+				received = time.Now()
+			}
+			// optionally, spill the events of large messages to disk while
+			// they are read, so that the parsed events of each message
+			// held in memory are bounded. The raw message is already
+			// entirely in memory at this point
+			if values, spill, ok, err := k.spillEventList(bytes); ok {
+				if err != nil {
+					logger.Warnf("%s", err.Error())
+					series.AddDroppedMessage(dropReasonParseError)
+					k.countError(errorCategorySchema)
+					k.writeDeadLetter(err, bytes)
 					return
 				}
-				jsonValue, err := fastjson.ParseBytes(bytes)
-				if err != nil {
-					k.logger.Println(err.Error())
-					continue
+				atomic.AddUint64(series.eventsParsed, uint64(len(values)))
+				if k.tracer != nil {
+					parsed = time.Now()
 				}
-				values, err := k.parseJSONMessage(jsonValue)
+				for _, v := range values {
+					sendEvent(v)
+				}
+				flushEvents()
+				if spill != nil {
+					spillDone = make(chan struct{})
+					ack.hold()
+					go func(ack *messageAck, received, parsed time.Time, done chan struct{}) {
+						defer close(done)
+						defer ack.release()
+						prepare := func(v *auditEvent) bool {
+							v.Received, v.Parsed = received, parsed
+							return prepareEvent(v, ack)
+						}
+						send := func(evs []*auditEvent) bool {
+							atomic.AddInt64(queued, int64(len(evs)))
+							select {
+							case newEventChan <- evs:
+								return true
+							case <-ctx.Done():
+								atomic.AddInt64(queued, -int64(len(evs)))
+								return false
+							}
+						}
+						if err := k.readSpilledEvents(spill, batchSize, logger, series, prepare, send); err != nil {
+							logger.Warnf("can't read spill file: %s", err.Error())
+						}
+					}(ack, received, parsed, spillDone)
+				}
+				return
+			}
+			jsonValue, msg, err := parseMessage(bytes)
+			if err != nil {
+				logger.Warnf("%s", err.Error())
+				series.AddDroppedMessage(dropReasonParseError)
+				k.countError(errorCategoryJSONParse)
+				k.writeDeadLetter(err, bytes)
+				return
+			}
+			values, err := k.parseJSONMessage(jsonValue)
+			if err != nil {
+				msg.attach(nil)
+				logger.Warnf("%s", err.Error())
+				series.AddDroppedMessage(dropReasonParseError)
+				k.countError(errorCategorySchema)
+				k.writeDeadLetter(err, bytes)
+				return
+			}
+			atomic.AddUint64(series.eventsParsed, uint64(len(values)))
+			msg.attach(values)
+			if len(values) == 1 && values[0].Data == jsonValue {
+				values[0].Raw = bytes
+			}
+			if k.tracer != nil {
+				parsed = time.Now()
+			}
+			for _, v := range values {
+				sendEvent(v)
+			}
+			flushEvents()
+		}
+		// optionally, inject synthetic heartbeat events periodically
+		var heartbeat <-chan time.Time
+		if k.Config.HeartbeatPeriodSecs > 0 {
+			ticker := time.NewTicker(time.Duration(k.Config.HeartbeatPeriodSecs) * time.Second)
+			defer ticker.Stop()
+			heartbeat = ticker.C
+		}
+		for {
+			select {
+			case now := <-heartbeat:
+				ev, err := k.newHeartbeatEvent(name, now)
 				if err != nil {
-					k.logger.Println(err.Error())
+					logger.Warnf("can't create heartbeat event: %s", err.Error())
 					continue
 				}
-				for _, v := range values {
-					newEventChan <- v
+				received, parsed = now, now
+				sendEvent(ev)
+				flushEvents()
+			case msg, ok := <-eventChan:
+				if !ok {
+					return
 				}
+				ack = newMessageAck(msg.done)
+				received = msg.received
+				handleMessage(msg.data)
+				ack.release()
+				ack = nil
 			case <-ctx.Done():
 				return
 			case err, ok := <-errorChan:
@@ -220,83 +740,334 @@ func (k *Plugin) openEventSource(ctx context.Context, eventChan <-chan []byte, e
 		}
 	}()
 
+	// optionally, sort the events by timestamp within a time window
+	var resEventChan <-chan []*auditEvent = newEventChan
+	var resErrorChan <-chan error = newErrorChan
+	if k.Config.ReorderWindowMs > 0 {
+		window := time.Duration(k.Config.ReorderWindowMs) * time.Millisecond
+		resEventChan, resErrorChan = reorderEvents(ctx, window, newEventChan, newErrorChan)
+	}
+
 	// create custom-sized evt batch
-	evts, err := sdk.NewEventWriters(int64(sdk.DefaultBatchSize), int64(k.Config.MaxEventSize))
+	evts, err := sdk.NewEventWriters(int64(batchSize), int64(k.Config.MaxEventSize))
 	if err != nil {
 		return nil, err
 	}
 
 	// return event source
+	k.metrics.AddQueue(name, func() int {
+		return len(eventChan) + int(atomic.LoadInt64(queued))
+	})
 	res := &eventSource{
+		name:      name,
+		logger:    logger,
+		metrics:   &k.metrics,
+		series:    series,
 		eof:       false,
 		ctx:       ctx,
-		eventChan: newEventChan,
-		errorChan: newErrorChan,
+		eventChan: resEventChan,
+		errorChan: resErrorChan,
+		queued:    queued,
 		cancel:    onClose,
+		timeout:   time.Duration(k.Config.BatchTimeoutMs) * time.Millisecond,
 	}
 	res.SetEvents(evts)
 	return res, nil
 }
 
+// isDuplicate returns true if the dedup store is enabled and the event
+// has already been emitted
+func (k *Plugin) isDuplicate(ev *auditEvent) bool {
+	if k.dedup == nil {
+		return false
+	}
+	if len(ev.dedupKey) == 0 {
+		ev.dedupKey = dedupKey(ev)
+	}
+	return len(ev.dedupKey) > 0 && k.dedup.Contains(ev.dedupKey)
+}
+
+// setEmitted records an emitted event in the dedup store, if enabled
+func (k *Plugin) setEmitted(ev *auditEvent) {
+	if k.dedup != nil && len(ev.dedupKey) > 0 {
+		if err := k.dedup.Add(ev.dedupKey); err != nil {
+			k.logger.Warnf("can't update dedup store: %s", err.Error())
+		}
+	}
+}
+
+// writeDeadLetter writes a payload that failed parsing to the
+// dead-letter file, if enabled.
+func (k *Plugin) writeDeadLetter(reason error, payload []byte) {
+	if k.deadLetter != nil {
+		if err := k.deadLetter.Write(reason.Error(), payload); err != nil {
+			k.logger.Warnf("can't write dead letter: %s", err.Error())
+		}
+	}
+}
+
+// Progress returns the read progress of file sources. Other sources
+// have no notion of progress, and always report zero.
+func (e *eventSource) Progress(pState sdk.PluginState) (float64, string) {
+	if e.progress == nil {
+		return 0, ""
+	}
+	return e.progress()
+}
+
 func (e *eventSource) Close() {
+	if e.metrics != nil {
+		e.metrics.RemoveQueue(e.name)
+	}
 	if e.cancel != nil {
 		e.cancel()
 	}
 }
 
 func (e *eventSource) NextBatch(pState sdk.PluginState, evts sdk.EventWriters) (int, error) {
+	n, err := e.nextBatch(pState, evts)
+	if n > 0 {
+		atomic.AddUint64(e.series.eventsEmitted, uint64(n))
+		e.series.batchFill.Observe(float64(n) / float64(evts.Len()))
+	}
+	return n, err
+}
+
+func (e *eventSource) nextBatch(pState sdk.PluginState, evts sdk.EventWriters) (int, error) {
 	if e.eof {
-		return 0, sdk.ErrEOF
+		err := e.eofError()
+		if err == sdk.ErrTimeout {
+			time.Sleep(e.timeout)
+		}
+		return 0, err
 	}
 
-	var data []byte
+	// the serialization buffer is sized after the largest event of the
+	// previous batch, and is reused for all the events of this batch
+	data := getBuffer(e.bufSize)
+	maxSize := 0
+	defer func() {
+		e.bufSize = maxSize
+		putBuffer(data)
+	}()
+
 	i := 0
-	timeout := time.After(defaultEventTimeout)
+	timeout := time.After(e.timeout)
 	plugin := pState.(*Plugin)
 	for i < evts.Len() {
-		select {
-		// an event is received, so we add it in the batch
-		case ev, ok := <-e.eventChan:
-			if !ok {
-				// event channel is closed, we reached EOF
+		if len(e.pending) == 0 {
+			select {
+			// a batch of events is received, so we add them in the batch
+			case evs, ok := <-e.eventChan:
+				if !ok {
+					// event channel is closed, we reached EOF
+					e.eof = true
+					return i, e.eofError()
+				}
+				e.pending = evs
+			// timeout hits, so we flush a partial batch
+			case <-timeout:
+				return i, sdk.ErrTimeout
+			// context has been canceled, so we exit
+			case <-e.ctx.Done():
 				e.eof = true
 				return i, sdk.ErrEOF
-			}
-			// todo: we may want to optimize this path.
-			// First, we parse the JSON message using fastjson, then we extract
-			// the subvalues for each audit event contained in the event, then
-			// we marshal each of them in byte slices, and finally we copy those
-			// bytes in the io.Writer. In this case, we are constrained by fastjson,
-			// maybe we should consider using a different JSON package here.
-			data = ev.Data.MarshalTo(nil)
-			if len(data) > int(plugin.Config.MaxEventSize) {
-				plugin.logger.Printf("dropped event larger than maxEventSize: size=%d", len(data))
-				continue
-			}
-			if _, err := evts.Get(i).Writer().Write(data); err != nil {
+			// an error occurs, so we exit
+			case err, ok := <-e.errorChan:
+				if !ok {
+					err = e.eofError()
+				}
+				e.eof = true
 				return i, err
 			}
-			evts.Get(i).SetTimestamp(uint64(ev.Timestamp.UnixNano()))
-			i++
-		// timeout hits, so we flush a partial batch
-		case <-timeout:
-			return i, sdk.ErrTimeout
-		// context has been canceled, so we exit
-		case <-e.ctx.Done():
-			e.eof = true
-			return i, sdk.ErrEOF
-		// an error occurs, so we exit
-		case err, ok := <-e.errorChan:
-			if !ok {
-				err = sdk.ErrEOF
+			continue
+		}
+		ev := e.pending[0]
+		e.pending[0] = nil
+		e.pending = e.pending[1:]
+		atomic.AddInt64(e.queued, -1)
+
+		// duplicates of an event that was still queued when they
+		// have been received are discarded here
+		if plugin.isDuplicate(ev) {
+			e.series.AddDropped(dropReasonDuplicate)
+			ev.release()
+			ev.delivered()
+			continue
+		}
+
+		// Events that are the whole received message are written with
+		// their original bytes, unless they get modified. Otherwise, we
+		// parse the JSON message using fastjson, then we extract
+		// the subvalues for each audit event contained in the event, then
+		// we marshal each of them in byte slices, and finally we copy those
+		// bytes in the io.Writer.
+		if plugin.redactEvent(ev.Data) {
+			ev.Raw = nil
+		}
+		maxEventSize := int(plugin.Config.MaxEventSize)
+		out := ev.Raw
+		if out == nil || len(out) > maxEventSize {
+			// the size of the event is checked before serializing it, so
+			// that large events are not materialized just to be dropped
+			out = nil
+			if !jsonSizeExceeds(ev.Data, maxEventSize) {
+				data = ev.Data.MarshalTo(data[:0])
+				out = data
+			} else if plugin.Config.TruncateLargeEvents {
+				if truncated := plugin.truncateEvent(ev.Data, data); truncated != nil {
+					data = truncated
+					out = data
+					e.logger.Infof("truncated event larger than maxEventSize: truncatedSize=%d", len(out))
+				}
+			}
+			if len(data) > maxSize {
+				maxSize = len(data)
 			}
-			e.eof = true
+		}
+		if out == nil || len(out) > maxEventSize {
+			e.logger.Warnf("dropped event larger than maxEventSize: maxEventSize=%d", maxEventSize)
+			e.series.AddDropped(dropReasonOversize)
+			plugin.countError(errorCategoryOversize)
+			ev.release()
+			ev.delivered()
+			continue
+		}
+		if _, err := evts.Get(i).Writer().Write(out); err != nil {
 			return i, err
 		}
+		evts.Get(i).SetTimestamp(uint64(ev.Timestamp.UnixNano()))
+		plugin.setEmitted(ev)
+		e.series.ingestLag.Observe(time.Since(ev.Timestamp).Seconds())
+		atomic.StoreInt64(&plugin.metrics.lastEventTime, ev.Timestamp.UnixNano())
+		if plugin.tracer != nil && plugin.tracer.Sample() {
+			plugin.tracer.RecordEvent(ev, e.name, time.Now())
+		}
+		ev.release()
+		ev.delivered()
+		i++
 	}
 	return i, nil
 }
 
+// eofError returns the error signaling that the source reached EOF. In idle
+// mode, the source stays open without producing events until it gets
+// closed, so that it does not terminate the capture.
+func (e *eventSource) eofError() error {
+	if e.idleAtEOF && e.ctx.Err() == nil {
+		return sdk.ErrTimeout
+	}
+	return sdk.ErrEOF
+}
+
+// truncateEvent removes the heaviest fields of an audit event until its
+// serialized size fits in MaxEventSize. The responseObject is removed first,
+// followed by the requestObject, so that the event metadata is always
+// preserved. Returns the serialized event, or nil if removing both objects
+// is not enough. The event is serialized in data, which is reused if large
+// enough.
+func (k *Plugin) truncateEvent(value *fastjson.Value, data []byte) []byte {
+	for _, key := range []string{"responseObject", "requestObject"} {
+		value.Del(key)
+		if !jsonSizeExceeds(value, int(k.Config.MaxEventSize)) {
+			return value.MarshalTo(data[:0])
+		}
+	}
+	return nil
+}
+
+// jsonSizeExceeds returns true if the serialized size of a JSON value is
+// larger than limit. The size is computed by walking the value without
+// serializing it, and the walk stops as soon as the limit is exceeded.
+// Escape sequences are not accounted for, so the value may still be larger
+// than limit once serialized even if false is returned.
+func jsonSizeExceeds(value *fastjson.Value, limit int) bool {
+	return jsonSize(value, limit) > limit
+}
+
+// jsonSize returns the serialized size of a JSON value, excluding escape
+// sequences. The returned size is only accurate up to limit, as the walk
+// stops as soon as it is exceeded.
+func jsonSize(value *fastjson.Value, limit int) int {
+	switch value.Type() {
+	case fastjson.TypeObject:
+		obj, _ := value.Object()
+		if obj.Len() == 0 {
+			return 2
+		}
+		// braces, quotes, colons, and commas
+		size := 1
+		obj.Visit(func(key []byte, v *fastjson.Value) {
+			if size <= limit {
+				size += len(key) + 4 + jsonSize(v, limit-size)
+			}
+		})
+		return size
+	case fastjson.TypeArray:
+		arr, _ := value.Array()
+		if len(arr) == 0 {
+			return 2
+		}
+		// brackets and commas
+		size := 1
+		for _, v := range arr {
+			if size > limit {
+				break
+			}
+			size += 1 + jsonSize(v, limit-size)
+		}
+		return size
+	case fastjson.TypeString:
+		return len(value.GetStringBytes()) + 2
+	default:
+		var buf [32]byte
+		return len(value.MarshalTo(buf[:0]))
+	}
+}
+
+// redactEvent replaces the values of the data and stringData entries of
+// the request and response objects of an audit event, if the event targets
+// a resource for which redaction is enabled in the plugin configuration.
+// The entry keys are preserved, so that rules can still see what is being
+// changed. List responses are redacted item by item. Returns true if the
+// event has been modified.
+func (k *Plugin) redactEvent(value *fastjson.Value) bool {
+	switch string(value.GetStringBytes("objectRef", "resource")) {
+	case "secrets":
+		if !k.Config.RedactSecrets {
+			return false
+		}
+	case "configmaps":
+		if !k.Config.RedactConfigMaps {
+			return false
+		}
+	default:
+		return false
+	}
+	modified := false
+	var arena fastjson.Arena
+	redacted := arena.NewString(redactedValue)
+	for _, key := range []string{"requestObject", "responseObject"} {
+		obj := value.Get(key)
+		if obj == nil {
+			continue
+		}
+		objs := []*fastjson.Value{obj}
+		objs = append(objs, obj.GetArray("items")...)
+		for _, o := range objs {
+			for _, dataKey := range []string{"data", "stringData", "binaryData"} {
+				if data := o.GetObject(dataKey); data != nil {
+					data.Visit(func(k []byte, v *fastjson.Value) {
+						data.Set(string(k), redacted)
+						modified = true
+					})
+				}
+			}
+		}
+	}
+	return modified
+}
+
 func (k *Plugin) parseJSONMessage(value *fastjson.Value) ([]*auditEvent, error) {
 	if value == nil {
 		return nil, fmt.Errorf("can't parse nil JSON message")
@@ -333,6 +1104,14 @@ func (k *Plugin) parseJSONMessage(value *fastjson.Value) ([]*auditEvent, error)
 			}
 			return []*auditEvent{event}, nil
 		}
+	} else if value.Get("auditID") != nil && value.Get("stage") != nil && value.Get("verb") != nil {
+		// some log shippers strip the kind and apiVersion fields,
+		// so we recognize those objects as audit events too
+		event, err := k.parseJSONAuditEvent(value)
+		if err != nil {
+			return nil, err
+		}
+		return []*auditEvent{event}, nil
 	}
 	return nil, fmt.Errorf("data not recognized as a k8s audit event")
 }
@@ -0,0 +1,522 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/falcosecurity/plugin-sdk-go/pkg/sdk"
+	"github.com/valyala/fastjson"
+)
+
+// testEvent implements sdk.EventWriter in Go memory
+type testEvent struct {
+	data bytes.Buffer
+	ts   uint64
+}
+
+func (t *testEvent) Writer() io.Writer         { return &t.data }
+func (t *testEvent) SetTimestamp(value uint64) { t.ts = value }
+
+// testEvents implements sdk.EventWriters in Go memory
+type testEvents []*testEvent
+
+func newTestEvents(size int) testEvents {
+	res := make(testEvents, size)
+	for i := range res {
+		res[i] = &testEvent{}
+	}
+	return res
+}
+
+func (t testEvents) Get(eventIndex int) sdk.EventWriter { return t[eventIndex] }
+func (t testEvents) Len() int                           { return len(t) }
+func (t testEvents) ArrayPtr() unsafe.Pointer           { return nil }
+func (t testEvents) Free()                              {}
+
+// initTestPlugin returns a plugin initialized with the given JSON config
+func initTestPlugin(t *testing.T, config string) *Plugin {
+	p := &Plugin{}
+	if err := p.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Destroy)
+	return p
+}
+
+// nextTestBatch reads the next batch of events from an event source, and
+// returns the data of the events
+func nextTestBatch(p *Plugin, src interface{}, evts testEvents) ([]string, error) {
+	for _, e := range evts {
+		e.data.Reset()
+	}
+	n, err := src.(sdk.NextBatcher).NextBatch(p, evts)
+	var res []string
+	for _, e := range evts[:n] {
+		res = append(res, e.data.String())
+	}
+	return res, err
+}
+
+// readTestEvents reads events from an event source until EOF, or until at
+// least max events have been read if max is greater than zero
+func readTestEvents(t *testing.T, p *Plugin, src interface{}, max int) []string {
+	var res []string
+	evts := newTestEvents(int(p.Config.BatchSize))
+	for max <= 0 || len(res) < max {
+		batch, err := nextTestBatch(p, src, evts)
+		res = append(res, batch...)
+		if err == sdk.ErrEOF {
+			break
+		}
+		if err != nil && err != sdk.ErrTimeout {
+			t.Fatal(err)
+		}
+	}
+	return res
+}
+
+// testAuditEvent returns a minimal audit event with the given audit ID
+func testAuditEvent(auditID string) string {
+	return fmt.Sprintf(`{"kind":"Event","auditID":"%s","stage":"ResponseComplete","verb":"get","stageTimestamp":"2022-01-01T00:00:00.000000Z"}`, auditID)
+}
+
+// auditIDs returns the set of the audit IDs of the given events
+func auditIDs(t *testing.T, events []string) map[string]bool {
+	res := make(map[string]bool)
+	for _, e := range events {
+		res[string(fastjson.MustParse(e).GetStringBytes("auditID"))] = true
+	}
+	return res
+}
+
+func TestRedactEvent(t *testing.T) {
+	p := &Plugin{}
+	p.Config.Reset()
+	p.Config.RedactSecrets = true
+
+	secret := `{"objectRef":{"resource":"secrets"},"requestObject":{"data":{"password":"aHVudGVyMg=="}},"responseObject":{"items":[{"stringData":{"token":"s3cr3t"}}]}}`
+	value := fastjson.MustParse(secret)
+	p.redactEvent(value)
+	data := string(value.MarshalTo(nil))
+	if strings.Contains(data, "aHVudGVyMg==") || strings.Contains(data, "s3cr3t") {
+		t.Errorf("secret data not redacted: %s", data)
+	}
+	if !strings.Contains(data, `"password":"`+redactedValue+`"`) {
+		t.Errorf("secret data keys not preserved: %s", data)
+	}
+
+	configMap := `{"objectRef":{"resource":"configmaps"},"requestObject":{"data":{"key":"value"}}}`
+	value = fastjson.MustParse(configMap)
+	p.redactEvent(value)
+	if data := string(value.MarshalTo(nil)); data != configMap {
+		t.Errorf("configmap data unexpectedly redacted: %s", data)
+	}
+}
+
+func TestParseJSONMessage(t *testing.T) {
+	p := &Plugin{}
+	p.Config.Reset()
+
+	tests := []struct {
+		name  string
+		json  string
+		count int
+		err   bool
+	}{
+		{
+			name:  "event",
+			json:  `{"kind":"Event","auditID":"1","stage":"ResponseComplete","verb":"get","stageTimestamp":"2022-01-01T00:00:00.000000Z"}`,
+			count: 1,
+		},
+		{
+			name:  "event list",
+			json:  `{"kind":"EventList","items":[{"auditID":"1","stageTimestamp":"2022-01-01T00:00:00.000000Z"},{"auditID":"2","stageTimestamp":"2022-01-01T00:00:00.000000Z"}]}`,
+			count: 2,
+		},
+		{
+			name:  "kind-less event",
+			json:  `{"auditID":"1","stage":"ResponseComplete","verb":"get","stageTimestamp":"2022-01-01T00:00:00.000000Z"}`,
+			count: 1,
+		},
+		{
+			name: "unrecognized object",
+			json: `{"auditID":"1","stageTimestamp":"2022-01-01T00:00:00.000000Z"}`,
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events, err := p.parseJSONMessage(fastjson.MustParse(test.json))
+			if test.err != (err != nil) {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if len(events) != test.count {
+				t.Errorf("expected %d events, got %d", test.count, len(events))
+			}
+		})
+	}
+}
+
+func TestOpenBatchSize(t *testing.T) {
+	p := &Plugin{}
+	p.Config.Reset()
+	p.Config.BatchSize = 128
+
+	tests := []struct {
+		query     string
+		batchSize uint64
+		err       bool
+	}{
+		{query: "", batchSize: 128},
+		{query: "batchSize=512", batchSize: 512},
+		{query: "batchSize=512&token=abc", batchSize: 512},
+		{query: "token=abc", batchSize: 128},
+		{query: "batchSize=0", err: true},
+		{query: "batchSize=abc", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			query, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			batchSize, err := p.openBatchSize(query)
+			if test.err != (err != nil) {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if batchSize != test.batchSize {
+				t.Errorf("expected batch size %d, got %d", test.batchSize, batchSize)
+			}
+		})
+	}
+}
+
+func TestFileCheckpointResume(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.json")
+	var sb strings.Builder
+	for i := 0; i < 300; i++ {
+		sb.WriteString(testAuditEvent(fmt.Sprint(i)) + "\n")
+	}
+	if err := ioutil.WriteFile(path, []byte(sb.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := fmt.Sprintf(`{"fileCheckpointPath":%q,"batchSize":10}`, filepath.Join(dir, "checkpoints.json"))
+
+	// stop partway, while more events are queued in the source
+	p := initTestPlugin(t, config)
+	src, err := p.OpenFilePath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := readTestEvents(t, p, src, 100)
+	src.(sdk.Closer).Close()
+
+	// no event must be lost when resuming from the checkpoint
+	p = initTestPlugin(t, config)
+	src, err = p.OpenFilePath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := readTestEvents(t, p, src, 0)
+	src.(sdk.Closer).Close()
+	if len(second) >= 300 {
+		t.Errorf("expected to resume from the checkpoint, got %d events", len(second))
+	}
+	if ids := auditIDs(t, append(first, second...)); len(ids) != 300 {
+		t.Errorf("expected 300 distinct events, got %d", len(ids))
+	}
+}
+
+func TestFileMalformedJSON(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.json")
+	data := testAuditEvent("1") + "\n" +
+		`{"kind":"Event","auditID":"2", "stage": }` + "\n" +
+		testAuditEvent("3") + "\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	deadLetter := filepath.Join(dir, "deadletter.log")
+	p := initTestPlugin(t, fmt.Sprintf(`{"deadLetterPath":%q}`, deadLetter))
+	src, err := p.OpenFilePath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.(sdk.Closer).Close()
+	ids := auditIDs(t, readTestEvents(t, p, src, 0))
+	if len(ids) != 2 || !ids["1"] || !ids["3"] {
+		t.Errorf("expected the events around the malformed line, got %v", ids)
+	}
+	if dl, err := ioutil.ReadFile(deadLetter); err != nil || !strings.Contains(string(dl), `"auditID":"2"`) {
+		t.Errorf("expected the malformed line in the dead-letter file, got %q (%v)", dl, err)
+	}
+}
+
+func TestEventBatchBoundaries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.json")
+	data := `{"kind":"EventList","items":[` +
+		strings.Join([]string{testAuditEvent("0"), testAuditEvent("1"), testAuditEvent("2"), testAuditEvent("3"), testAuditEvent("4")}, ",") +
+		"]}\n" + testAuditEvent("5") + "\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := initTestPlugin(t, `{"batchSize":2}`)
+	src, err := p.OpenFilePath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.(sdk.Closer).Close()
+
+	// the events of each message are handed off in batches of up to
+	// batchSize events, and batches never span messages
+	var sizes []int
+	var ids []string
+	for evs := range src.(*eventSource).eventChan {
+		sizes = append(sizes, len(evs))
+		for _, ev := range evs {
+			ids = append(ids, string(ev.Data.GetStringBytes("auditID")))
+		}
+	}
+	if fmt.Sprint(sizes) != "[2 2 1 1]" {
+		t.Errorf("expected batches of sizes [2 2 1 1], got %v", sizes)
+	}
+	if strings.Join(ids, ",") != "0,1,2,3,4,5" {
+		t.Errorf("expected the events in order, got %v", ids)
+	}
+}
+
+func TestNextBatchSpansHandoffs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.json")
+	var sb strings.Builder
+	for i := 0; i < 6; i++ {
+		sb.WriteString(testAuditEvent(fmt.Sprint(i)) + "\n")
+	}
+	if err := ioutil.WriteFile(path, []byte(sb.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := initTestPlugin(t, `{"batchSize":2,"batchTimeoutMs":10000}`)
+	src, err := p.OpenFilePath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.(sdk.Closer).Close()
+
+	// a batch is filled with the events of several hand-offs, up to its
+	// capacity, without waiting for the batch timeout
+	evts := newTestEvents(4)
+	batch, err := nextTestBatch(p, src, evts)
+	if err != nil || len(batch) != 4 {
+		t.Fatalf("expected a full batch of 4 events, got %d (%v)", len(batch), err)
+	}
+	batch, err = nextTestBatch(p, src, evts)
+	if err != sdk.ErrEOF || len(batch) != 2 {
+		t.Fatalf("expected the 2 remaining events and EOF, got %d (%v)", len(batch), err)
+	}
+}
+
+func TestNextBatchTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.json")
+	data := testAuditEvent("1") + "\n" + testAuditEvent("2") + "\n" + testAuditEvent("3") + "\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := initTestPlugin(t, `{"batchSize":10,"batchTimeoutMs":50,"fileEOFBehavior":"follow"}`)
+	src, err := p.OpenFilePath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.(sdk.Closer).Close()
+
+	// a partial batch is flushed once the batch timeout expires
+	evts := newTestEvents(10)
+	start := time.Now()
+	batch, err := nextTestBatch(p, src, evts)
+	if err != sdk.ErrTimeout || len(batch) != 3 {
+		t.Fatalf("expected a partial batch of 3 events on timeout, got %d (%v)", len(batch), err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected the batch to be flushed after the timeout, got %s", elapsed)
+	}
+
+	// an empty batch is returned if no event is received
+	batch, err = nextTestBatch(p, src, evts)
+	if err != sdk.ErrTimeout || len(batch) != 0 {
+		t.Errorf("expected an empty batch on timeout, got %d (%v)", len(batch), err)
+	}
+}
+
+func TestFileEOFBehavior(t *testing.T) {
+	data := testAuditEvent("1") + "\n" + testAuditEvent("2") + "\n"
+	for _, behavior := range []string{fileEOFClose, fileEOFIdle, fileEOFFollow} {
+		t.Run(behavior, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.json")
+			if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			p := initTestPlugin(t, fmt.Sprintf(`{"fileEOFBehavior":%q,"batchTimeoutMs":20}`, behavior))
+			src, err := p.OpenFilePath(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer src.(sdk.Closer).Close()
+			if ids := auditIDs(t, readTestEvents(t, p, src, 2)); len(ids) != 2 {
+				t.Fatalf("expected 2 events, got %v", ids)
+			}
+
+			// only the close behavior terminates the source at the end
+			// of the file
+			evts := newTestEvents(int(p.Config.BatchSize))
+			for i := 0; i < 3; i++ {
+				batch, err := nextTestBatch(p, src, evts)
+				expected := sdk.ErrTimeout
+				if behavior == fileEOFClose {
+					expected = sdk.ErrEOF
+				}
+				if err != expected || len(batch) != 0 {
+					t.Fatalf("expected no events and %v at EOF, got %d (%v)", expected, len(batch), err)
+				}
+			}
+
+			// only the follow behavior reads the data appended later
+			file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			if _, err := file.WriteString(testAuditEvent("3") + "\n"); err != nil {
+				t.Fatal(err)
+			}
+			if behavior != fileEOFFollow {
+				return
+			}
+			var events []string
+			for i := 0; i < 100 && len(events) == 0; i++ {
+				events, err = nextTestBatch(p, src, evts)
+				if err != nil && err != sdk.ErrTimeout {
+					t.Fatal(err)
+				}
+			}
+			if ids := auditIDs(t, events); len(ids) != 1 || !ids["3"] {
+				t.Errorf("expected the appended event, got %v", ids)
+			}
+		})
+	}
+}
+
+func TestNextBatchRawEvents(t *testing.T) {
+	// the whole-message events are written with their original bytes,
+	// while the modified events and the items of lists are serialized
+	unformatted := `{ "kind": "Event", "auditID": "1", "stage": "ResponseComplete", "verb": "get", "stageTimestamp": "2022-01-01T00:00:00.000000Z" }`
+	secret := `{ "kind": "Event", "auditID": "2", "stage": "ResponseComplete", "verb": "create", "stageTimestamp": "2022-01-01T00:00:00.000000Z",` +
+		` "objectRef": {"resource": "secrets"}, "requestObject": {"data": {"key": "c2VjcmV0"}} }`
+	list := `{"kind":"EventList","items":[{ "auditID": "3", "stageTimestamp": "2022-01-01T00:00:00.000000Z" }]}`
+	path := filepath.Join(t.TempDir(), "audit.json")
+	if err := ioutil.WriteFile(path, []byte(unformatted+"\n"+secret+"\n"+list+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := initTestPlugin(t, `{"redactSecrets":true}`)
+	src, err := p.OpenFilePath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.(sdk.Closer).Close()
+	events := readTestEvents(t, p, src, 0)
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+	if events[0] != unformatted {
+		t.Errorf("expected the original bytes of the event, got %s", events[0])
+	}
+	if events[1] == secret || strings.Contains(events[1], "c2VjcmV0") {
+		t.Errorf("expected the secret event to be redacted, got %s", events[1])
+	}
+	if events[2] != `{"auditID":"3","stageTimestamp":"2022-01-01T00:00:00.000000Z"}` {
+		t.Errorf("expected the list item to be serialized, got %s", events[2])
+	}
+}
+
+func TestNextBatchLargeEvents(t *testing.T) {
+	large := fmt.Sprintf(`{"kind":"Event","auditID":"2","stage":"ResponseComplete","verb":"create","stageTimestamp":"2022-01-01T00:00:00.000000Z","requestObject":{"data":%q}}`,
+		strings.Repeat("x", 2000))
+	data := testAuditEvent("1") + "\n" + large + "\n" + testAuditEvent("3") + "\n"
+	for _, truncate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("truncate=%v", truncate), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.json")
+			if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			p := initTestPlugin(t, fmt.Sprintf(`{"maxEventSize":1000,"truncateLargeEvents":%v}`, truncate))
+			src, err := p.OpenFilePath(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer src.(sdk.Closer).Close()
+			events := readTestEvents(t, p, src, 0)
+			ids := auditIDs(t, events)
+
+			// events larger than maxEventSize are either dropped or
+			// emitted without their objects
+			if truncate {
+				if len(ids) != 3 {
+					t.Fatalf("expected 3 events, got %v", ids)
+				}
+				for _, e := range events {
+					if len(e) > 1000 || strings.Contains(e, "requestObject") {
+						t.Errorf("expected the large event to be truncated, got %d bytes", len(e))
+					}
+				}
+				return
+			}
+			if len(ids) != 2 || ids["2"] {
+				t.Errorf("expected the large event to be dropped, got %v", ids)
+			}
+			if n := p.metrics.eventsDropped.SumWhere(1, dropReasonOversize); n != 1 {
+				t.Errorf("expected 1 oversize drop, got %d", n)
+			}
+		})
+	}
+}
+
+func TestJSONSizeExceeds(t *testing.T) {
+	for _, data := range []string{
+		`{}`,
+		`[]`,
+		`{"a":1,"b":[true,null,"x"],"c":{"d":-1.5}}`,
+		testAuditEvent("1"),
+	} {
+		value := fastjson.MustParse(data)
+		size := len(value.MarshalTo(nil))
+		if jsonSizeExceeds(value, size) {
+			t.Errorf("expected %s not to exceed its size %d", data, size)
+		}
+		if !jsonSizeExceeds(value, size-1) {
+			t.Errorf("expected %s to exceed %d", data, size-1)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+)
+
+// spillEventList streams the items of an EventList message, parsing the
+// first spillThreshold ones and writing the following ones to a temporary
+// file as they are read, without parsing them. Each spilled item is written
+// as a line of JSON, so that it can later be parsed on its own. Returns the
+// parsed events and the spill file, which is nil if there are not enough
+// items. Returns false if spilling is disabled, if the message is not an
+// EventList, or if the spill file can't be written, in which case the
+// message should be parsed as usual.
+func (k *Plugin) spillEventList(data []byte) ([]*auditEvent, *os.File, bool, error) {
+	threshold := int(k.Config.SpillThreshold)
+	if threshold == 0 {
+		return nil, nil, false, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := decoder.Token(); err != nil || tok != json.Delim('{') {
+		return nil, nil, false, nil
+	}
+
+	// the kind is expected to precede the items, as in the messages sent
+	// by the API server
+	isList := false
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, nil, false, nil
+		}
+		if key == "kind" {
+			var kind string
+			if err := decoder.Decode(&kind); err != nil || kind != "EventList" {
+				return nil, nil, false, nil
+			}
+			isList = true
+			continue
+		}
+		if key != "items" || !isList {
+			var skip json.RawMessage
+			if err := decoder.Decode(&skip); err != nil {
+				return nil, nil, false, nil
+			}
+			continue
+		}
+		if tok, err := decoder.Token(); err != nil || tok != json.Delim('[') {
+			return nil, nil, false, nil
+		}
+		return k.spillItems(decoder, threshold)
+	}
+	return nil, nil, false, nil
+}
+
+// spillItems reads the items of an EventList from the decoder, as
+// described by spillEventList
+func (k *Plugin) spillItems(decoder *json.Decoder, threshold int) ([]*auditEvent, *os.File, bool, error) {
+	var values []*auditEvent
+	var file *os.File
+	var writer *bufio.Writer
+	var line bytes.Buffer
+	abort := func(err error) ([]*auditEvent, *os.File, bool, error) {
+		for _, v := range values {
+			v.release()
+		}
+		if file != nil {
+			file.Close()
+		}
+		return nil, nil, err != nil, err
+	}
+	for decoder.More() {
+		var item json.RawMessage
+		if err := decoder.Decode(&item); err != nil {
+			return abort(nil)
+		}
+		if len(values) < threshold {
+			value, msg, err := parseMessage(item)
+			if err != nil {
+				return abort(err)
+			}
+			event, err := k.parseJSONAuditEvent(value)
+			if err != nil {
+				msg.attach(nil)
+				return abort(err)
+			}
+			msg.attach([]*auditEvent{event})
+			values = append(values, event)
+			continue
+		}
+		if file == nil {
+			var err error
+			if file, err = ioutil.TempFile(k.Config.SpillDir, pluginName+"-spill-"); err != nil {
+				k.logger.Warnf("can't create spill file: %s", err.Error())
+				return abort(nil)
+			}
+			// the file is unlinked right away, and gets deleted once closed
+			os.Remove(file.Name())
+			writer = bufio.NewWriter(file)
+		}
+		line.Reset()
+		if err := json.Compact(&line, item); err != nil {
+			return abort(nil)
+		}
+		line.WriteByte('\n')
+		if _, err := writer.Write(line.Bytes()); err != nil {
+			k.logger.Warnf("can't write spill file: %s", err.Error())
+			return abort(nil)
+		}
+	}
+	if file != nil {
+		err := writer.Flush()
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			k.logger.Warnf("can't write spill file: %s", err.Error())
+			return abort(nil)
+		}
+	}
+	return values, file, true, nil
+}
+
+// readSpilledEvents reads the events of a spill file, and passes them to
+// the send function in batches of up to batchSize events, until the file
+// is consumed or send returns false. Each event is passed to the prepare
+// function first, and is discarded if it returns false. Items that are not
+// valid audit events are dropped. The file is closed when done.
+func (k *Plugin) readSpilledEvents(file *os.File, batchSize uint64, logger *pluginLogger, series *sourceMetrics, prepare func(*auditEvent) bool, send func([]*auditEvent) bool) error {
+	defer file.Close()
+	var batch []*auditEvent
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			event, parseErr := k.parseSpilledEvent(line)
+			if parseErr != nil {
+				logger.Warnf("%s", parseErr.Error())
+				series.AddDropped(dropReasonParseError)
+				k.countError(errorCategorySchema)
+			} else {
+				atomic.AddUint64(series.eventsParsed, 1)
+				if prepare(event) {
+					batch = append(batch, event)
+				}
+			}
+		}
+		if len(batch) > 0 && (uint64(len(batch)) >= batchSize || err != nil) {
+			if !send(batch) {
+				return nil
+			}
+			batch = nil
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (k *Plugin) parseSpilledEvent(line []byte) (*auditEvent, error) {
+	value, msg, err := parseMessage(line)
+	if err != nil {
+		return nil, err
+	}
+	event, err := k.parseJSONAuditEvent(value)
+	if err != nil {
+		msg.attach(nil)
+		return nil, err
+	}
+	msg.attach([]*auditEvent{event})
+	return event, nil
+}
@@ -0,0 +1,60 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/falcosecurity/plugin-sdk-go/pkg/sdk"
+	"github.com/valyala/fastjson"
+)
+
+func TestSpillEventList(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.json")
+	var items []string
+	for i := 0; i < 250; i++ {
+		items = append(items, testAuditEvent(fmt.Sprint(i)))
+	}
+	data := `{"kind":"EventList","apiVersion":"audit.k8s.io/v1","items":[` + strings.Join(items, ",") + "]}\n" +
+		testAuditEvent("250") + "\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := initTestPlugin(t, fmt.Sprintf(`{"spillThreshold":100,"spillDir":%q,"batchSize":16}`, dir))
+	src, err := p.OpenFilePath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.(sdk.Closer).Close()
+
+	// the events across the threshold, and the ones of the following
+	// message, are emitted in order
+	events := readTestEvents(t, p, src, 0)
+	if len(events) != 251 {
+		t.Fatalf("expected 251 events, got %d", len(events))
+	}
+	for i, ev := range events {
+		if id := string(fastjson.MustParse(ev).GetStringBytes("auditID")); id != fmt.Sprint(i) {
+			t.Fatalf("expected event %d, got %s", i, id)
+		}
+	}
+}
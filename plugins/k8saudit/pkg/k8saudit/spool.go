@@ -0,0 +1,403 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spoolSegmentExt     = ".seg"
+	spoolCursorFile     = "cursor.json"
+	spoolSegmentMaxSize = 16 * 1024 * 1024
+	spoolRecordHdrSize  = 4
+	spoolPollInterval   = time.Second
+)
+
+var (
+	errSpoolFull      = errors.New("spool size limit reached")
+	errSpoolCorrupted = errors.New("spool segment corrupted")
+)
+
+// spoolCursor is the read position of the spool, persisted in the spool
+// directory so that consumption resumes from where it was left.
+type spoolCursor struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// diskSpool is a persistent FIFO queue of webhook messages, backed by
+// append-only segment files. Each record is a message prefixed by its
+// length as a 4-byte big-endian integer. The cursor only advances past a
+// record once all the events of its message have been emitted, and
+// segments are removed once the cursor has moved past them.
+type diskSpool struct {
+	dir        string
+	maxSize    int64
+	maxMsgSize int64
+	logger     *pluginLogger
+	mu         sync.Mutex
+	writeSeg   uint64
+	writeFile  *os.File
+	writeSize  int64
+	totalSize  int64
+	notify     chan struct{}
+
+	// the committed cursor is only accessed by the commit functions
+	commits   *commitQueue
+	committed spoolCursor
+	lastSave  time.Time
+}
+
+// openDiskSpool opens the spool in the given directory, creating it if
+// needed. Messages left in the directory by a previous run are preserved
+// and are consumed before the new ones. Writes are rejected once the total
+// size of the segments exceeds maxSize. Records longer than maxMsgSize
+// are considered corrupted.
+func openDiskSpool(dir string, maxSize, maxMsgSize int64, logger *pluginLogger) (*diskSpool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &diskSpool{
+		dir:        dir,
+		maxSize:    maxSize,
+		maxMsgSize: maxMsgSize,
+		logger:     logger,
+		notify:     make(chan struct{}, 1),
+		commits:    newCommitQueue(),
+	}
+	segs, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segs {
+		info, err := os.Stat(s.segmentPath(seg))
+		if err != nil {
+			return nil, err
+		}
+		s.totalSize += info.Size()
+	}
+	// always start writing to a new segment, so that a record possibly
+	// left partially-written by a crash is never followed by new ones
+	if len(segs) > 0 {
+		s.writeSeg = segs[len(segs)-1]
+	}
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Write appends a message to the spool. Returns errSpoolFull if the
+// message does not fit in the configured size limit.
+func (s *diskSpool) Write(msg []byte) error {
+	recSize := int64(spoolRecordHdrSize + len(msg))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.totalSize+recSize > s.maxSize {
+		return errSpoolFull
+	}
+	if s.writeSize > 0 && s.writeSize+recSize > spoolSegmentMaxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	rec := make([]byte, recSize)
+	binary.BigEndian.PutUint32(rec, uint32(len(msg)))
+	copy(rec[spoolRecordHdrSize:], msg)
+	n, err := s.writeFile.Write(rec)
+	if err != nil {
+		// a partially-written record would make the following ones
+		// unreadable, so it's either truncated or left at the end of a
+		// segment that is not written anymore
+		if n > 0 && s.writeFile.Truncate(s.writeSize) != nil {
+			s.totalSize += int64(n)
+			s.rotate()
+		}
+		return err
+	}
+	s.writeSize += int64(n)
+	s.totalSize += int64(n)
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run reads the spooled messages in order and sends them to eventChan,
+// until the given context is cancelled. The cursor is committed by the done
+// callbacks of the messages, and is saved periodically and before returning.
+func (s *diskSpool) Run(ctx context.Context, eventChan chan<- sourceMessage) error {
+	cursor, err := s.readCursor()
+	if err != nil {
+		return err
+	}
+	s.committed = *cursor
+	defer s.close()
+	defer s.commits.Do(func() { s.writeCursor(&s.committed) })
+
+	// segments already consumed in a previous run
+	if err := s.removeSegmentsBefore(cursor.Segment); err != nil {
+		return err
+	}
+	for ctx.Err() == nil {
+		segs, err := s.segments()
+		if err != nil {
+			return err
+		}
+		idx := sort.Search(len(segs), func(i int) bool { return segs[i] >= cursor.Segment })
+		if idx == len(segs) {
+			// should not happen, as the write segment always exists
+			return fmt.Errorf("spool segment %d not found", cursor.Segment)
+		}
+		if segs[idx] != cursor.Segment {
+			cursor = &spoolCursor{Segment: segs[idx]}
+		}
+
+		eof, err := s.readSegment(ctx, cursor, eventChan)
+		if err == errSpoolCorrupted {
+			// the following records of the segment can't be located, so
+			// the rest of the segment is skipped
+			s.logger.Warnf("skipping the rest of spool segment %d: corrupted record at offset %d", cursor.Segment, cursor.Offset)
+			s.mu.Lock()
+			if cursor.Segment == s.writeSeg {
+				err = s.rotate()
+			} else {
+				err = nil
+			}
+			s.mu.Unlock()
+			if err != nil {
+				return err
+			}
+			cursor = &spoolCursor{Segment: cursor.Segment + 1}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !eof {
+			continue
+		}
+
+		// the segment is fully read, either move to the next one or wait
+		// for new messages if it's the one being written
+		s.mu.Lock()
+		writing := cursor.Segment == s.writeSeg
+		s.mu.Unlock()
+		if writing {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-s.notify:
+			case <-time.After(spoolPollInterval):
+			}
+			continue
+		}
+		cursor = &spoolCursor{Segment: cursor.Segment + 1}
+	}
+	return nil
+}
+
+// readSegment sends the records of the segment pointed by the cursor to
+// eventChan, advancing the cursor after each of them. Returns true if the
+// end of the segment has been reached, and false if the reading has been
+// interrupted by the context. Returns errSpoolCorrupted if a record is
+// longer than the maximum message size.
+func (s *diskSpool) readSegment(ctx context.Context, cursor *spoolCursor, eventChan chan<- sourceMessage) (bool, error) {
+	file, err := os.Open(s.segmentPath(cursor.Segment))
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(cursor.Offset, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	reader := bufio.NewReader(file)
+	hdr := make([]byte, spoolRecordHdrSize)
+	for {
+		// a partial record is either being written or has been left by a
+		// crash, and in both cases is treated as the end of the segment
+		if _, err := io.ReadFull(reader, hdr); err != nil {
+			return isEOF(err), ignoreEOF(err)
+		}
+		size := int64(binary.BigEndian.Uint32(hdr))
+		if size > s.maxMsgSize {
+			return false, errSpoolCorrupted
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(reader, msg); err != nil {
+			return isEOF(err), ignoreEOF(err)
+		}
+		offset := cursor.Offset + int64(spoolRecordHdrSize+len(msg))
+		select {
+		case <-ctx.Done():
+			return false, nil
+		case eventChan <- sourceMessage{data: msg, done: s.commit(cursor.Segment, offset)}:
+			cursor.Offset = offset
+		}
+	}
+}
+
+// commit returns the done callback of the record ending at the given
+// offset of a segment, which advances the committed cursor. The segments
+// preceding the committed one are removed.
+func (s *diskSpool) commit(seg uint64, offset int64) func() {
+	return s.commits.Add(func() {
+		if seg > s.committed.Segment {
+			if err := s.removeSegmentsBefore(seg); err != nil {
+				s.logger.Warnf("can't remove spool segments: %s", err.Error())
+			}
+		}
+		s.committed = spoolCursor{Segment: seg, Offset: offset}
+		if time.Since(s.lastSave) >= checkpointSaveInterval {
+			if err := s.writeCursor(&s.committed); err != nil {
+				s.logger.Warnf("can't save spool cursor: %s", err.Error())
+			}
+			s.lastSave = time.Now()
+		}
+	})
+}
+
+func (s *diskSpool) rotate() error {
+	if s.writeFile != nil {
+		if err := s.writeFile.Close(); err != nil {
+			return err
+		}
+	}
+	s.writeSeg++
+	file, err := os.OpenFile(s.segmentPath(s.writeSeg), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.writeFile = file
+	s.writeSize = 0
+	return nil
+}
+
+// removeSegmentsBefore removes the segments preceding the given one
+func (s *diskSpool) removeSegmentsBefore(seg uint64) error {
+	segs, err := s.segments()
+	if err != nil {
+		return err
+	}
+	for _, prev := range segs {
+		if prev >= seg {
+			break
+		}
+		if err := s.removeSegment(prev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *diskSpool) removeSegment(seg uint64) error {
+	path := s.segmentPath(seg)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.totalSize -= info.Size()
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *diskSpool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeFile.Close()
+}
+
+// segments returns the sequence numbers of the segments in the spool
+// directory, in ascending order.
+func (s *diskSpool) segments() ([]uint64, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []uint64
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), spoolSegmentExt) {
+			continue
+		}
+		seg, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), spoolSegmentExt), 10, 64)
+		if err == nil {
+			segs = append(segs, seg)
+		}
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	return segs, nil
+}
+
+func (s *diskSpool) segmentPath(seg uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seg, spoolSegmentExt))
+}
+
+func (s *diskSpool) readCursor() (*spoolCursor, error) {
+	cursor := &spoolCursor{}
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, spoolCursorFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cursor, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cursor); err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
+
+func (s *diskSpool) writeCursor(cursor *spoolCursor) error {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, spoolCursorFile), data)
+}
+
+func isEOF(err error) bool {
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+func ignoreEOF(err error) error {
+	if isEOF(err) {
+		return nil
+	}
+	return err
+}
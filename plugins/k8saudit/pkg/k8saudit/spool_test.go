@@ -0,0 +1,121 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func testLogger(t *testing.T) *pluginLogger {
+	logger, err := newPluginLogger(ioutil.Discard, logLevelWarn.String(), logFormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return logger
+}
+
+// runTestSpool runs a spool until the given amount of messages is received
+// and returns them, along with a function stopping the spool
+func runTestSpool(t *testing.T, s *diskSpool, count int) ([]sourceMessage, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	eventChan := make(chan sourceMessage)
+	errorChan := make(chan error, 1)
+	go func() { errorChan <- s.Run(ctx, eventChan) }()
+	stop := func() {
+		cancel()
+		if err := <-errorChan; err != nil {
+			t.Fatal(err)
+		}
+	}
+	var res []sourceMessage
+	for len(res) < count {
+		select {
+		case msg := <-eventChan:
+			res = append(res, msg)
+		case err := <-errorChan:
+			t.Fatalf("spool stopped: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for spool messages")
+		}
+	}
+	return res, stop
+}
+
+func TestDiskSpoolCommit(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openDiskSpool(dir, 1<<20, 1024, testLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"a", "b", "c"} {
+		if err := s.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the first message is done, so the others must be read again
+	msgs, stop := runTestSpool(t, s, 3)
+	msgs[0].done()
+	stop()
+
+	s, err = openDiskSpool(dir, 1<<20, 1024, testLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, stop = runTestSpool(t, s, 2)
+	defer stop()
+	if string(msgs[0].data) != "b" || string(msgs[1].data) != "c" {
+		t.Errorf("expected undelivered messages to be read again, got %q and %q", msgs[0].data, msgs[1].data)
+	}
+}
+
+func TestDiskSpoolCorruptedRecord(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openDiskSpool(dir, 1<<20, 1024, testLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+
+	// append a record header with an impossible length
+	file, err := os.OpenFile(s.segmentPath(s.writeSeg), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0xff, 0xff, 0xff, 0xff, 'x'})
+	file.Close()
+
+	s, err = openDiskSpool(dir, 1<<20, 1024, testLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	msgs, stop := runTestSpool(t, s, 2)
+	defer stop()
+	if string(msgs[0].data) != "a" || string(msgs[1].data) != "b" {
+		t.Errorf("expected the records around the corrupted one, got %q and %q", msgs[0].data, msgs[1].data)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// startSummaryLog starts logging a summary of the plugin metrics at each
+// interval, until the returned function is called
+func (k *Plugin) startSummaryLog(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		lastEmitted := k.metrics.eventsEmitted.Sum()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				emitted := k.metrics.eventsEmitted.Sum()
+				k.logSummary(float64(emitted-lastEmitted) / interval.Seconds())
+				lastEmitted = emitted
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (k *Plugin) logSummary(eventsPerSec float64) {
+	lastEvent := "none"
+	if ts := atomic.LoadInt64(&k.metrics.lastEventTime); ts > 0 {
+		lastEvent = time.Unix(0, ts).UTC().Format(time.RFC3339Nano)
+	}
+	lagP50, _ := k.metrics.ingestLag.Quantile(0.5)
+	lagP99, _ := k.metrics.ingestLag.Quantile(0.99)
+	k.logger.Infof("summary: eventsPerSec=%.1f, emitted=%d, dropped=%d, droppedMessages=%d, parseErrors=%d, errors=%d, queueDepth=%d, lastEventTimestamp=%s, lagP50=%.3fs, lagP99=%.3fs",
+		eventsPerSec,
+		k.metrics.eventsEmitted.Sum(),
+		k.metrics.eventsDropped.Sum(),
+		k.metrics.messagesDropped.Sum(),
+		k.metrics.eventsDropped.SumWhere(1, dropReasonParseError)+k.metrics.messagesDropped.SumWhere(1, dropReasonParseError),
+		k.metrics.errors.Sum(),
+		k.metrics.QueueDepth(),
+		lastEvent,
+		lagP50,
+		lagP99)
+}
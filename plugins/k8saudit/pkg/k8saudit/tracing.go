@@ -0,0 +1,227 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	tracingExportPath     = "/v1/traces"
+	tracingExportInterval = 5 * time.Second
+	tracingMaxBatch       = 512
+	tracingQueueSize      = 8192
+)
+
+// otlpSpan is a span in the OTLP/HTTP JSON encoding
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func newOTLPAttribute(key, value string) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	a.Value.StringValue = value
+	return a
+}
+
+// tracer records the spans of the ingest path of each audit event, and
+// exports them in batches to an OpenTelemetry collector through the
+// OTLP/HTTP protocol with JSON encoding. Each event produces a trace made
+// of a root span starting at the event stageTimestamp, as set by the API
+// server, and ending when the event is emitted to Falco. The root span has
+// a child for the parsing of the message containing the event, and a child
+// for the time spent queued before emission. Only a ratio of the events
+// is traced, and the spans that can't be queued for export are counted in
+// the dropped counter.
+type tracer struct {
+	endpoint    string
+	sampleRatio float64
+	client      *http.Client
+	logger      *pluginLogger
+	dropped     *uint64
+	spans       chan otlpSpan
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+func newTracer(endpoint string, sampleRatio float64, dropped *uint64, logger *pluginLogger) *tracer {
+	t := &tracer{
+		endpoint:    strings.TrimSuffix(endpoint, "/") + tracingExportPath,
+		sampleRatio: sampleRatio,
+		client:      &http.Client{Timeout: tracingExportInterval},
+		logger:      logger,
+		dropped:     dropped,
+		spans:       make(chan otlpSpan, tracingQueueSize),
+		done:        make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.run()
+	return t
+}
+
+// Sample returns true if the next emitted event should be traced
+func (t *tracer) Sample() bool {
+	return t.sampleRatio >= 1 || rand.Float64() < t.sampleRatio
+}
+
+// RecordEvent records the spans of an audit event that has been emitted
+func (t *tracer) RecordEvent(ev *auditEvent, source string, emitted time.Time) {
+	traceID := randomHex(16)
+	rootID := randomHex(8)
+	attrs := []otlpAttribute{
+		newOTLPAttribute("k8saudit.audit_id", string(ev.Data.GetStringBytes("auditID"))),
+		newOTLPAttribute("k8saudit.verb", string(ev.Data.GetStringBytes("verb"))),
+		newOTLPAttribute("k8saudit.source", source),
+	}
+	t.record(otlpSpan{
+		TraceID:    traceID,
+		SpanID:     rootID,
+		Name:       pluginName + ".event",
+		Start:      unixNanoString(ev.Timestamp),
+		End:        unixNanoString(emitted),
+		Attributes: attrs,
+	})
+	t.record(otlpSpan{
+		TraceID:      traceID,
+		SpanID:       randomHex(8),
+		ParentSpanID: rootID,
+		Name:         pluginName + ".parse",
+		Start:        unixNanoString(ev.Received),
+		End:          unixNanoString(ev.Parsed),
+	})
+	t.record(otlpSpan{
+		TraceID:      traceID,
+		SpanID:       randomHex(8),
+		ParentSpanID: rootID,
+		Name:         pluginName + ".queue",
+		Start:        unixNanoString(ev.Parsed),
+		End:          unixNanoString(emitted),
+	})
+}
+
+// Shutdown exports the pending spans and stops the tracer
+func (t *tracer) Shutdown() {
+	close(t.done)
+	t.wg.Wait()
+}
+
+func (t *tracer) record(span otlpSpan) {
+	// spans are dropped rather than slowing down the ingest path
+	span.Kind = 1 // SPAN_KIND_INTERNAL
+	select {
+	case t.spans <- span:
+	default:
+		atomic.AddUint64(t.dropped, 1)
+	}
+}
+
+func (t *tracer) run() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(tracingExportInterval)
+	defer ticker.Stop()
+	var batch []otlpSpan
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) < tracingMaxBatch {
+				continue
+			}
+		case <-ticker.C:
+		case <-t.done:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+			t.export(batch)
+			return
+		}
+		t.export(batch)
+		batch = batch[:0]
+	}
+}
+
+func (t *tracer) export(spans []otlpSpan) {
+	if len(spans) == 0 {
+		return
+	}
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{newOTLPAttribute("service.name", pluginName)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": pluginName},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.logger.Warnf("can't encode trace spans: %s", err.Error())
+		return
+	}
+	res, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.logger.Warnf("can't export trace spans: %s", err.Error())
+		return
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		t.logger.Warnf("can't export trace spans: unexpected status %s", res.Status)
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func unixNanoString(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -0,0 +1,49 @@
+/*
+Copyright (C) 2022 The Falco Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8saudit
+
+import (
+	"testing"
+)
+
+func TestTracerSample(t *testing.T) {
+	for _, ratio := range []float64{0, 1} {
+		tr := &tracer{sampleRatio: ratio}
+		for i := 0; i < 100; i++ {
+			if tr.Sample() != (ratio == 1) {
+				t.Fatalf("unexpected sampling with ratio %g", ratio)
+			}
+		}
+	}
+}
+
+func TestTracerDroppedSpans(t *testing.T) {
+	var m pluginMetrics
+	tr := &tracer{
+		dropped: m.spansDropped.With(),
+		spans:   make(chan otlpSpan, 2),
+	}
+	for i := 0; i < 5; i++ {
+		tr.record(otlpSpan{Name: "test"})
+	}
+	if len(tr.spans) != 2 {
+		t.Errorf("expected 2 queued spans, got %d", len(tr.spans))
+	}
+	if n := m.spansDropped.Sum(); n != 3 {
+		t.Errorf("expected 3 dropped spans, got %d", n)
+	}
+}